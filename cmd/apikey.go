@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	apiKeyCreateCmd.Flags().String("name", "", "what the key is for, i.e. the service using it")
+	apiKeyCreateCmd.Flags().StringSlice("scope", []string{data.ScopeWrite}, "scopes the key grants")
+	apiKeyCreateCmd.Flags().String("tenant", "", "restrict the key to the avatars of a tenant")
+
+	apiKeyCmd.AddCommand(apiKeyCreateCmd, apiKeyListCmd, apiKeyRevokeCmd)
+	RootCmd.AddCommand(apiKeyCmd)
+}
+
+// loadAPIKeys reads the keys of the config, connecting to the store only
+// when it keeps keys as well
+func loadAPIKeys() *data.APIKeyRing {
+	if err := data.LoadConfig("config"); err != nil {
+		log.Println(err)
+	}
+
+	var db data.DB
+	if viper.GetString("ApiKeyStore") == "db" {
+		db = serveLoadDB()
+	}
+
+	keys, err := data.LoadAPIKeys(db)
+	if err != nil {
+		log.Fatalln("Please make sure the API keys are configured.", err)
+	}
+	return keys
+}
+
+func apiKeyCreateRun(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("name")
+	scopes, _ := cmd.Flags().GetStringSlice("scope")
+	tenant, _ := cmd.Flags().GetString("tenant")
+	if len(name) == 0 {
+		log.Fatalln("Name the key with --name.")
+	}
+
+	ring := loadAPIKeys()
+	key, raw, err := data.NewAPIKey(name, scopes, tenant)
+	if err != nil {
+		log.Fatalln("Unable to create the key.", err)
+	}
+
+	if store := ring.Store(); store != nil {
+		if err := store.SaveAPIKey(key); err != nil {
+			log.Fatalln("Unable to save the key.", err)
+		}
+		fmt.Printf("Created API key %s. Send it in the %s header, it is not shown again:\n\n", key.ID, data.APIKeyHeader)
+		fmt.Println(raw)
+		return
+	}
+
+	// Without a store, the key is added to the config by hand
+	entry, _ := json.MarshalIndent(map[string]interface{}{
+		"id":     key.ID,
+		"name":   key.Name,
+		"hash":   key.Hash,
+		"scopes": key.Scopes,
+		"tenant": key.Tenant,
+	}, "    ", "  ")
+	fmt.Printf("Add this entry to ApiKeys in the config, and restart the service:\n\n    %s\n\n", entry)
+	fmt.Printf("Then send this key in the %s header, it is not shown again:\n\n", data.APIKeyHeader)
+	fmt.Println(raw)
+}
+
+func apiKeyListRun(cmd *cobra.Command, args []string) {
+	keys, err := loadAPIKeys().List()
+	if err != nil {
+		log.Fatalln("Unable to list the keys.", err)
+	}
+
+	for _, key := range keys {
+		lastUsed := "never"
+		if key.Source == "config" {
+			lastUsed = "see /admin/apikeys"
+		} else if key.LastUsedAt != nil {
+			lastUsed = key.LastUsedAt.Format("2006-01-02 15:04:05")
+		}
+		tenant := key.Tenant
+		if len(tenant) == 0 {
+			tenant = "*"
+		}
+		fmt.Printf("%-16s  %-20s %-28s %-12s %-6s %s\n",
+			key.ID, key.Name, strings.Join(key.Scopes, " "), tenant, key.Source, lastUsed)
+	}
+}
+
+func apiKeyRevokeRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalln("Pass the ID of the key to revoke.")
+	}
+	id := args[0]
+
+	ring := loadAPIKeys()
+	keys, err := ring.List()
+	if err != nil {
+		log.Fatalln("Unable to list the keys.", err)
+	}
+	for _, key := range keys {
+		if key.ID == id && key.Source == "config" {
+			log.Fatalln("The key is in the config. Remove it from ApiKeys and restart the service.")
+		}
+	}
+
+	store := ring.Store()
+	if store == nil {
+		log.Fatalln("No API key has the ID", id)
+	}
+	if err := store.DeleteAPIKey(id); err == data.ErrAPIKeyNotFound {
+		log.Fatalln("No API key has the ID", id)
+	} else if err != nil {
+		log.Fatalln("Unable to revoke the key.", err)
+	}
+	fmt.Println("Revoked API key", id)
+}
+
+var apiKeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "Manage the API keys of services",
+	Long:  `Creates, lists and revokes the API keys services can change avatars with`,
+}
+
+var apiKeyCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an API key",
+	Long: `Creates an API key with a random secret. With ApiKeyStore set to db the key
+is saved right away, otherwise an entry for the ApiKeys config is printed.`,
+	Run: apiKeyCreateRun,
+}
+
+var apiKeyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the API keys",
+	Run:   apiKeyListRun,
+}
+
+var apiKeyRevokeCmd = &cobra.Command{
+	Use:   "revoke ID",
+	Short: "Revoke an API key kept by the database",
+	Run:   apiKeyRevokeRun,
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	fsckCmd.Flags().IntP("batch", "b", 100, "number of avatars to load at once")
+	fsckCmd.Flags().String("cursor", "", "resume from the cursor of a previous run")
+	fsckCmd.Flags().Bool("quick", false, "skip downloading the files to check their dimensions")
+	fsckCmd.Flags().Bool("repair", false, "regenerate or remove the sizes with problems")
+
+	RootCmd.AddCommand(fsckCmd)
+}
+
+// fsckResult lists the problems of a single avatar
+type fsckResult struct {
+	Hash     string         `json:"hash"`
+	Problems []data.Problem `json:"problems"`
+	Repaired bool           `json:"repaired"`
+	Error    string         `json:"error,omitempty"`
+
+	// Unrepairable is set when --repair can fix none of the problems
+	Unrepairable bool `json:"unrepairable,omitempty"`
+}
+
+// fsckReport summarizes a consistency check
+type fsckReport struct {
+	Checked      int          `json:"checked"`
+	Failed       int          `json:"failed"`
+	Repaired     int          `json:"repaired"`
+	Unrepairable int          `json:"unrepairable"`
+	Cursor       string       `json:"cursor"`
+	Avatars      []fsckResult `json:"avatars"`
+}
+
+func fsckRun(cmd *cobra.Command, args []string) {
+	app := serveLoadConfig()
+
+	batch, _ := cmd.Flags().GetInt("batch")
+	cursor, _ := cmd.Flags().GetString("cursor")
+	quick, _ := cmd.Flags().GetBool("quick")
+	repair, _ := cmd.Flags().GetBool("repair")
+
+	report := &fsckReport{Cursor: cursor, Avatars: []fsckResult{}}
+	defer printFsckReport(report)
+
+	for {
+		avatars, next, err := app.DB.List(report.Cursor, batch, data.ListFilter{})
+		if err != nil {
+			log.Println("Unable to list avatars.", err)
+			return
+		}
+
+		for _, avatar := range avatars {
+			report.Checked++
+
+			problems, err := data.CheckAvatar(app.Storage, *avatar, !quick)
+			if err != nil {
+				report.Failed++
+				report.Avatars = append(report.Avatars, fsckResult{Hash: avatar.Hash, Error: err.Error()})
+				continue
+			}
+			if len(problems) == 0 {
+				continue
+			}
+
+			result := fsckResult{Hash: avatar.Hash, Problems: problems}
+			if repair && !data.Repairable(problems) {
+				result.Unrepairable = true
+				report.Unrepairable++
+			} else if repair {
+				if _, err := data.RepairAvatar(app, *avatar, problems); err != nil {
+					result.Error = err.Error()
+				} else {
+					result.Repaired = true
+					report.Repaired++
+				}
+			}
+			report.Avatars = append(report.Avatars, result)
+		}
+
+		// Progress goes to stderr to keep the report on stdout parseable
+		fmt.Fprintf(os.Stderr, "checked %d, with problems %d, cursor %q\n", report.Checked, len(report.Avatars), next)
+
+		report.Cursor = next
+		if len(next) == 0 {
+			break
+		}
+	}
+}
+
+func printFsckReport(report *fsckReport) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check that the database and the stored files agree",
+	Long: `Walks every avatar and checks that each of its sizes exists in the bucket
+with the expected content type and dimensions. A JSON report is printed on
+stdout. With --repair, broken sizes are regenerated from the master file and
+missing sizes are regenerated or removed from the avatar.`,
+	Run: fsckRun,
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	gcCmd.Flags().String("prefix", "", "only collect files below this prefix")
+	gcCmd.Flags().Duration("grace", 24*time.Hour, "ignore files younger than this")
+	gcCmd.Flags().Bool("delete", false, "delete the orphaned files instead of only reporting them")
+	gcCmd.Flags().Float64("rate", 10, "maximum database lookups and deletions per second (0 for no limit)")
+	gcCmd.Flags().Bool("json", false, "print the report as JSON")
+
+	RootCmd.AddCommand(gcCmd)
+}
+
+func gcRun(cmd *cobra.Command, args []string) {
+	app := serveLoadConfig()
+
+	opts := data.GCOptions{}
+	opts.Prefix, _ = cmd.Flags().GetString("prefix")
+	opts.Grace, _ = cmd.Flags().GetDuration("grace")
+	opts.Delete, _ = cmd.Flags().GetBool("delete")
+	opts.Rate, _ = cmd.Flags().GetFloat64("rate")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	var progress func(data.Orphan)
+	if !asJSON {
+		progress = func(orphan data.Orphan) {
+			switch {
+			case orphan.Deleted:
+				fmt.Println("deleted", orphan.Key)
+			case len(orphan.Error) > 0:
+				fmt.Println("failed to delete", orphan.Key, orphan.Error)
+			default:
+				fmt.Println("orphaned", orphan.Key)
+			}
+		}
+	}
+
+	report, err := data.CollectGarbage(app, opts, progress)
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		fmt.Printf("scanned %d files, %d orphaned (%d bytes), %d deleted, %d within grace period, %d unrecognized\n",
+			report.Scanned, len(report.Orphans), report.OrphanBytes, report.Deleted, report.Recent, report.Unrecognized)
+	}
+
+	if err != nil {
+		log.Fatalln("Garbage collection stopped early.", err)
+	}
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find and delete files no avatar references",
+	Long: `Lists the files in the bucket and checks each one against the database.
+Files that belong to neither an avatar nor one of its previous versions are
+reported, or deleted with --delete. Files younger than the grace period are
+skipped, as they may belong to an upload in progress.`,
+	Run: gcRun,
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	idMigrateCmd.Flags().Bool("keep", false, "keep the legacy avatars, so old URLs keep working for now")
+
+	idCmd.AddCommand(idDeriveCmd, idMigrateCmd)
+	RootCmd.AddCommand(idCmd)
+}
+
+func idDeriveRun(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatalln("Pass the identifiers to derive the IDs of.")
+	}
+	if err := data.LoadConfig("config"); err != nil {
+		log.Println(err)
+	}
+
+	for _, identifier := range args {
+		id, err := data.DeriveID(identifier)
+		if err != nil {
+			log.Fatalln("Unable to derive the ID.", err)
+		}
+		fmt.Println(id)
+	}
+}
+
+// idMigrateRun moves the avatars of the identifiers read from stdin, one per
+// line. The legacy hashes cannot be reversed, so only the identifiers
+// passed in are moved.
+func idMigrateRun(cmd *cobra.Command, args []string) {
+	app := serveLoadConfig()
+	keep, _ := cmd.Flags().GetBool("keep")
+
+	var moved, skipped, failed int
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		identifier := strings.TrimSpace(scanner.Text())
+		if len(identifier) == 0 {
+			continue
+		}
+
+		legacy := data.LegacyID(identifier)
+		avatar, err := data.MigrateLegacyAvatar(app, identifier, keep)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("%s: failed: %s\n", legacy, err)
+		case avatar == nil:
+			skipped++
+		default:
+			moved++
+			fmt.Printf("%s: moved to %s\n", legacy, avatar.Hash)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalln("Unable to read the identifiers.", err)
+	}
+
+	fmt.Printf("moved %d, nothing to move %d, failed %d\n", moved, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+var idCmd = &cobra.Command{
+	Use:   "id",
+	Short: "Derive avatar IDs from identifiers",
+	Long: `Derives the IDs avatars are stored under from identifiers like email
+addresses, using the IdentifierKey`,
+}
+
+var idDeriveCmd = &cobra.Command{
+	Use:   "derive IDENTIFIER...",
+	Short: "Print the IDs of identifiers",
+	Run:   idDeriveRun,
+}
+
+var idMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move avatars from their SHA1 hash to their derived ID",
+	Long: `Reads identifiers from stdin, one per line, and moves the avatar stored
+under the SHA1 of each one to its derived ID. The legacy avatar and its
+previous versions are removed unless --keep is set, i.e.:
+
+  psql -Atc "SELECT email FROM users" | avatar id migrate`,
+	Run: idMigrateRun,
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	migrateUpCmd.Flags().Int("steps", 0, "number of migrations to apply (0 for all)")
+	migrateDownCmd.Flags().Int("steps", 1, "number of migrations to roll back")
+
+	migrateCmd.AddCommand(migrateStatusCmd, migrateUpCmd, migrateDownCmd)
+	RootCmd.AddCommand(migrateCmd)
+}
+
+// loadMigrator connects to the configured store. Stores without versioned
+// migrations are only set up by their Migrate method.
+func loadMigrator() (*data.Application, data.Migrator) {
+	app := serveLoadConfig()
+
+	m, _ := data.AsMigrator(app.DB)
+	return app, m
+}
+
+func migrateStatusRun(cmd *cobra.Command, args []string) {
+	_, m := loadMigrator()
+	if m == nil {
+		fmt.Println("The configured store has no versioned schema.")
+		return
+	}
+
+	status, err := m.MigrationStatus()
+	if err != nil {
+		log.Fatalln("Unable to read the schema version.", err)
+	}
+
+	for _, s := range status {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-30s %s\n", s.Version, s.Name, applied)
+	}
+}
+
+func migrateUpRun(cmd *cobra.Command, args []string) {
+	app, m := loadMigrator()
+	if m == nil {
+		if err := app.DB.Migrate(); err != nil {
+			log.Fatalln("Migration failed.", err)
+		}
+		fmt.Println("Store is set up.")
+		return
+	}
+
+	steps, _ := cmd.Flags().GetInt("steps")
+	count, err := m.MigrateUp(steps)
+	fmt.Println("Applied", count, "migrations.")
+	if err != nil {
+		log.Fatalln("Migration failed.", err)
+	}
+}
+
+func migrateDownRun(cmd *cobra.Command, args []string) {
+	_, m := loadMigrator()
+	if m == nil {
+		log.Fatalln("The configured store has no versioned schema to roll back.")
+	}
+
+	steps, _ := cmd.Flags().GetInt("steps")
+	count, err := m.MigrateDown(steps)
+	fmt.Println("Rolled back", count, "migrations.")
+	if err != nil {
+		log.Fatalln("Migration failed.", err)
+	}
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the database schema",
+	Long:  `Shows, applies and rolls back the versioned migrations of the database schema`,
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List the migrations and whether they are applied",
+	Run:   migrateStatusRun,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply pending migrations",
+	Run:   migrateUpRun,
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Roll back applied migrations",
+	Run:   migrateDownRun,
+}
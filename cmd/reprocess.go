@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	reprocessCmd.Flags().IntP("concurrency", "c", 4, "number of avatars to reprocess at once")
+	reprocessCmd.Flags().IntP("batch", "b", 100, "number of avatars to load at once")
+	reprocessCmd.Flags().String("cursor", "", "resume from the cursor of a previous run")
+	reprocessCmd.Flags().Bool("dry-run", false, "report the sizes to regenerate without changing anything")
+	reprocessCmd.Flags().BoolP("force", "f", false, "regenerate every size, not only the missing ones")
+
+	RootCmd.AddCommand(reprocessCmd)
+}
+
+// reprocessStats counts the outcomes of a reprocess run
+type reprocessStats struct {
+	sync.Mutex
+	processed int
+	updated   int
+	failed    int
+}
+
+func reprocessRun(cmd *cobra.Command, args []string) {
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	batch, _ := cmd.Flags().GetInt("batch")
+	cursor, _ := cmd.Flags().GetString("cursor")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	force, _ := cmd.Flags().GetBool("force")
+	if concurrency < 1 {
+		log.Fatalln("The concurrency must be at least 1.")
+	}
+	if batch < 1 {
+		log.Fatalln("The batch must be at least 1.")
+	}
+
+	app := serveLoadConfig()
+
+	opts := data.ReprocessOptions{Force: force, DryRun: dryRun}
+	stats := &reprocessStats{}
+
+	for {
+		avatars, next, err := app.DB.List(cursor, batch, data.ListFilter{})
+		if err != nil {
+			log.Fatalln("Unable to list avatars.", err)
+		}
+
+		reprocessBatch(app, avatars, opts, concurrency, stats)
+
+		// Every avatar up to the cursor is done, so it is safe to resume from
+		fmt.Printf("processed %d, updated %d, failed %d, cursor %q\n", stats.processed, stats.updated, stats.failed, next)
+
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+}
+
+func reprocessBatch(app *data.Application, avatars []*data.Avatar, opts data.ReprocessOptions, concurrency int, stats *reprocessStats) {
+	jobs := make(chan *data.Avatar)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for avatar := range jobs {
+				result, err := data.ReprocessAvatar(app, *avatar, opts)
+
+				stats.Lock()
+				stats.processed++
+				switch {
+				case err != nil:
+					stats.failed++
+					fmt.Printf("%s: failed: %s\n", avatar.Hash, err)
+				case len(result.Sizes) > 0:
+					stats.updated++
+					verb := "regenerated"
+					if opts.DryRun {
+						verb = "would regenerate"
+					}
+					fmt.Printf("%s: %s %s from %s\n", avatar.Hash, verb, strings.Join(result.Sizes, ", "), result.Source)
+				case result.Metadata:
+					stats.updated++
+					verb := "described"
+					if opts.DryRun {
+						verb = "would describe"
+					}
+					fmt.Printf("%s: %s files from %s\n", avatar.Hash, verb, result.Source)
+				}
+				stats.Unlock()
+			}
+		}()
+	}
+
+	for _, avatar := range avatars {
+		jobs <- avatar
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+var reprocessCmd = &cobra.Command{
+	Use:   "reprocess",
+	Short: "Regenerate the sizes of all avatars",
+	Long: `Walks every avatar in the database and derives missing sizes from its
+master file, or from its largest size if it has no master. Use --force to
+regenerate every size after changing the presets or quality.`,
+	Run: reprocessRun,
+}
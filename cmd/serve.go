@@ -3,6 +3,8 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"net"
+	"strings"
 
 	"github.com/dolfelt/avatar-go/data"
 	"github.com/dolfelt/avatar-go/routes"
@@ -11,13 +13,16 @@ import (
 )
 
 func init() {
-	serveCmd.Flags().BoolP("debug", "d", false, "disables security and increases logging")
+	serveCmd.Flags().BoolP("debug", "d", false, "increases logging")
+	serveCmd.Flags().String("auth-policy", "", "required, disabled or disabled-for-loopback")
 	serveCmd.Flags().StringP("port", "p", "3000", "choose a custom port")
 	serveCmd.Flags().StringP("addr", "a", "", "address to bind this service to")
+	serveCmd.Flags().Bool("migrate", false, "apply pending database migrations before starting")
 
 	viper.BindPFlag("Port", serveCmd.Flags().Lookup("port"))
 	viper.BindPFlag("Debug", serveCmd.Flags().Lookup("debug"))
 	viper.BindPFlag("IPAddress", serveCmd.Flags().Lookup("addr"))
+	viper.BindPFlag("AuthPolicy", serveCmd.Flags().Lookup("auth-policy"))
 
 	RootCmd.AddCommand(serveCmd)
 }
@@ -27,10 +32,57 @@ func serveLoadConfig() *data.Application {
 	if configErr != nil {
 		log.Println(configErr)
 	}
+	db := serveLoadDB()
+
+	var storage data.Storage
+	switch viper.GetString("Storage") {
+	case "disk":
+		storage = &data.DiskStorage{}
+	case "memory":
+		storage = &data.MemoryStorage{}
+	default:
+		storage = &data.S3Storage{}
+	}
+	if err := storage.Connect(); err != nil {
+		log.Fatalln("Please make sure the file storage is configured.", err)
+	}
+
+	keys, err := data.LoadKeySet()
+	if err != nil {
+		log.Fatalln("Please make sure the token keys are configured.", err)
+	}
+
+	tokens, err := data.LoadTokenStore(db)
+	if err != nil {
+		log.Fatalln("Please make sure the JwtReplayStore is configured.", err)
+	}
+
+	apiKeys, err := data.LoadAPIKeys(db)
+	if err != nil {
+		log.Fatalln("Please make sure the API keys are configured.", err)
+	}
+
+	return &data.Application{
+		DB:         db,
+		Storage:    storage,
+		Keys:       keys,
+		Tokens:     tokens,
+		APIKeys:    apiKeys,
+		AuthPolicy: viper.GetString("AuthPolicy"),
+		Debug:      viper.GetBool("Debug"),
+	}
+}
+
+// serveLoadDB connects to the configured store, behind the configured cache
+func serveLoadDB() data.DB {
 	var db data.DB
 	switch viper.GetString("Store") {
 	case "dynamodb":
 		db = &data.DynamoDB{}
+	case "bolt":
+		db = &data.BoltDB{}
+	case "memory":
+		db = &data.MemoryDB{}
 	default:
 		db = &data.PostgresDB{}
 	}
@@ -41,13 +93,30 @@ func serveLoadConfig() *data.Application {
 	})
 
 	if err != nil {
-		log.Fatalln("Please make sure Postgres is installed and configured.", err)
+		log.Fatalln("Please make sure the database is installed and configured.", err)
 	}
 
-	return &data.Application{
-		DB:    db,
-		Debug: viper.GetBool("Debug"),
+	var cache data.Cache
+	switch viper.GetString("Cache") {
+	case "memory":
+		cache = &data.MemoryCache{Size: viper.GetInt("CacheSize")}
+	case "redis":
+		redis := &data.RedisCache{}
+		if err := redis.Connect(); err != nil {
+			log.Fatalln("Please make sure Redis is running and configured.", err)
+		}
+		cache = redis
+	}
+	if cache != nil {
+		db = &data.CachedDB{
+			DB:      db,
+			Cache:   cache,
+			TTL:     viper.GetDuration("CacheTTL"),
+			MissTTL: viper.GetDuration("CacheMissTTL"),
+		}
 	}
+
+	return db
 }
 
 func serveRun(cmd *cobra.Command, args []string) {
@@ -57,7 +126,29 @@ func serveRun(cmd *cobra.Command, args []string) {
 		fmt.Println("Debugging mode enabled.")
 	}
 
-	app.DB.Migrate()
+	addr := viper.GetString("IPAddress")
+	if err := checkAuthPolicy(app.AuthPolicy, addr); err != nil {
+		log.Fatalln(err)
+	}
+
+	// The schema is only changed on request, as several instances may share it
+	if m, ok := data.AsMigrator(app.DB); ok {
+		if migrate, _ := cmd.Flags().GetBool("migrate"); migrate {
+			if _, err := m.MigrateUp(0); err != nil {
+				log.Fatalln("Migration failed.", err)
+			}
+		}
+
+		pending, err := data.PendingMigrations(m)
+		if err != nil {
+			log.Fatalln("Unable to read the schema version.", err)
+		}
+		if pending > 0 {
+			log.Fatalln("The database schema is", pending, "migrations behind. Run `avatar migrate up` first.")
+		}
+	} else if err := app.DB.Migrate(); err != nil {
+		log.Fatalln("Unable to set up the database.", err)
+	}
 
 	router := routes.Register(app)
 
@@ -67,10 +158,48 @@ func serveRun(cmd *cobra.Command, args []string) {
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start up the avatar service",
-	Long:  `Runs Avatar Go and connects to the PostgreSQL database`,
+	Long:  `Runs Avatar Go and connects to the configured database`,
 	Run:   serveRun,
 }
 
+// checkAuthPolicy refuses to serve without authentication on addresses
+// other hosts can reach, and warns loudly whenever it is off
+func checkAuthPolicy(policy string, addr string) error {
+	switch policy {
+	case data.AuthPolicyRequired:
+		return nil
+
+	case data.AuthPolicyDisabledForLoopback:
+		log.Println("WARNING: Authentication is disabled for requests from loopback addresses.")
+		log.Println("WARNING: Behind a proxy on the same host, this includes every request it forwards.")
+		return nil
+
+	case data.AuthPolicyDisabled:
+		if !isLoopbackAddr(addr) && !viper.GetBool("AllowAuthDisabled") {
+			return fmt.Errorf("AuthPolicy %q is only allowed when bound to localhost, "+
+				"use --addr 127.0.0.1 or set AllowAuthDisabled to override", policy)
+		}
+		log.Println("WARNING: ************************************************************")
+		log.Println("WARNING: Authentication is disabled. Anyone who can reach this")
+		log.Println("WARNING: service can upload, change and delete every avatar.")
+		log.Println("WARNING: ************************************************************")
+		return nil
+	}
+
+	return fmt.Errorf("unknown AuthPolicy %q, use %s, %s or %s", policy,
+		data.AuthPolicyRequired, data.AuthPolicyDisabled, data.AuthPolicyDisabledForLoopback)
+}
+
+// isLoopbackAddr tells whether the service is bound to the host itself only.
+// An empty address binds every interface.
+func isLoopbackAddr(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
 // _, err = db.Exec("SELECT hash FROM images LIMIT 1")
 // if err != nil {
 //   log.Fatalln("Please make sure Postgres is configured.", err)
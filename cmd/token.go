@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	tokenSignCmd.Flags().String("hash", "", "avatar the token grants")
+	tokenSignCmd.Flags().StringSlice("hashes", nil, "avatars the token grants")
+	tokenSignCmd.Flags().String("tenant", "", "tenant whose avatars the token grants")
+	tokenSignCmd.Flags().Bool("admin", false, "grant every avatar")
+	tokenSignCmd.Flags().StringSlice("scope", []string{data.ScopeWrite}, "scopes the token grants")
+	tokenSignCmd.Flags().Duration("ttl", time.Hour, "how long the token is valid")
+	tokenSignCmd.Flags().String("subject", "", "sub claim, recorded as the uploader")
+	tokenSignCmd.Flags().String("key", "", "PEM private key to sign with instead of the JwtKey")
+	tokenSignCmd.Flags().String("kid", "", "key ID to put in the token header")
+	viper.BindPFlag("JwtSigningKey", tokenSignCmd.Flags().Lookup("key"))
+	viper.BindPFlag("JwtSigningKid", tokenSignCmd.Flags().Lookup("kid"))
+
+	tokenInspectCmd.Flags().String("hash", "", "avatar of the request, if any")
+	tokenInspectCmd.Flags().String("scope", data.ScopeWrite, "scope the request requires")
+
+	tokenCmd.AddCommand(tokenSignCmd, tokenInspectCmd)
+	RootCmd.AddCommand(tokenCmd)
+}
+
+func tokenSignRun(cmd *cobra.Command, args []string) {
+	if err := data.LoadConfig("config"); err != nil {
+		log.Println(err)
+	}
+
+	key, err := data.LoadSigningKey(viper.GetString("JwtSigningKey"), viper.GetString("JwtSigningKid"))
+	if err != nil {
+		log.Fatalln("Unable to load the signing key.", err)
+	}
+
+	hash, _ := cmd.Flags().GetString("hash")
+	hashes, _ := cmd.Flags().GetStringSlice("hashes")
+	tenant, _ := cmd.Flags().GetString("tenant")
+	admin, _ := cmd.Flags().GetBool("admin")
+	scopes, _ := cmd.Flags().GetStringSlice("scope")
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	subject, _ := cmd.Flags().GetString("subject")
+
+	if len(hash) == 0 && len(hashes) == 0 && len(tenant) == 0 && !admin {
+		log.Fatalln("The token needs to grant something: use --hash, --hashes, --tenant or --admin.")
+	}
+
+	// Hashes are granted in the form requests are checked in
+	var ok bool
+	if len(hash) > 0 {
+		if hash, ok = data.NormalizeHash(hash); !ok {
+			log.Fatalln("The --hash is not a valid hash.")
+		}
+	}
+	for i := range hashes {
+		if hashes[i], ok = data.NormalizeHash(hashes[i]); !ok {
+			log.Fatalln("The --hashes are not all valid hashes.")
+		}
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iat":   now.Unix(),
+		"exp":   now.Add(ttl).Unix(),
+		"jti":   randomTokenID(),
+		"scope": strings.Join(scopes, " "),
+	}
+	if len(hash) > 0 {
+		claims["hash"] = hash
+	}
+	if len(hashes) > 0 {
+		claims["hashes"] = hashes
+	}
+	if len(tenant) > 0 {
+		claims["tenant"] = tenant
+	}
+	if admin {
+		claims["admin"] = true
+	}
+	if len(subject) > 0 {
+		claims["sub"] = subject
+	}
+
+	// Tokens are only accepted from the configured issuer and audience
+	if issuers := viper.GetStringSlice("JwtIssuers"); len(issuers) > 0 {
+		claims["iss"] = issuers[0]
+	}
+	if audience := viper.GetString("JwtAudience"); len(audience) > 0 {
+		claims["aud"] = audience
+	}
+
+	token, err := key.Sign(claims)
+	if err != nil {
+		log.Fatalln("Unable to sign the token.", err)
+	}
+	fmt.Println(token)
+}
+
+func randomTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tokenInspectRun goes through the checks of AuthRequired in the same order,
+// and stops at the first one that would reject the token
+func tokenInspectRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalln("Pass the token to inspect.")
+	}
+	raw := strings.TrimPrefix(strings.TrimSpace(args[0]), "Bearer ")
+	hash, _ := cmd.Flags().GetString("hash")
+	scope, _ := cmd.Flags().GetString("scope")
+
+	if err := data.LoadConfig("config"); err != nil {
+		log.Println(err)
+	}
+
+	if len(hash) > 0 {
+		var ok bool
+		if hash, ok = data.NormalizeHash(hash); !ok {
+			rejectToken(400, "invalid hash")
+		}
+	}
+
+	header, claims, err := decodeToken(raw)
+	if err != nil {
+		rejectToken(400, "the token cannot be decoded: %s", err)
+	}
+	printJSON("Header", header)
+	printJSON("Claims", claims)
+	if exp, ok := claims["exp"].(float64); ok {
+		expires := time.Unix(int64(exp), 0)
+		fmt.Printf("Expires: %s (%s)\n", expires.Format(time.RFC3339), relativeTime(expires))
+	}
+
+	keys, err := data.LoadKeySet()
+	if err != nil {
+		log.Fatalln("Unable to load the token keys.", err)
+	}
+	token, err := keys.ParseToken(raw)
+	if err != nil {
+		rejectToken(400, "%s", explainTokenError(err, claims))
+	}
+	fmt.Println("Signature and claims: ok")
+
+	var grant string
+	if len(hash) > 0 {
+		var db data.DB
+		if _, ok := token.Claims["tenant"]; ok {
+			// Only tenant grants look the avatar up
+			db = serveLoadDB()
+		}
+		grant, err = data.AuthorizeHash(db, token.Claims, hash)
+	} else {
+		grant, err = data.AuthorizeAll(token.Claims)
+	}
+	if err != nil {
+		rejectToken(403, "%s", err)
+	}
+	fmt.Println("Grant:", grant)
+
+	if err := data.CheckScope(token.Claims, scope); err != nil {
+		rejectToken(403, "%s (it grants %q)", err, strings.Join(data.TokenScopes(token.Claims), " "))
+	}
+	fmt.Println("Scope:", scope)
+
+	replay := viper.GetString("JwtReplayStore")
+	if jti, _ := token.Claims["jti"].(string); len(jti) > 0 && replay != "" && replay != "none" {
+		fmt.Printf("Note: the token is rejected once jti %q has been used, which is not checked here\n", jti)
+	}
+	fmt.Println("Accepted.")
+}
+
+// decodeToken reads the header and claims without verifying anything, so
+// they can be shown even for tokens that are rejected
+func decodeToken(raw string) (map[string]interface{}, map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("expected 3 segments, found %d", len(parts))
+	}
+
+	var header, claims map[string]interface{}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		segment, err := jwt.DecodeSegment(parts[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(segment, v); err != nil {
+			return nil, nil, err
+		}
+	}
+	return header, claims, nil
+}
+
+// explainTokenError turns the errors of the JWT library into the reason
+// AuthRequired rejects the token
+func explainTokenError(err error, claims map[string]interface{}) string {
+	verr, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return err.Error()
+	}
+
+	// The library reports every check that failed
+	var reasons []string
+	if verr.Errors&jwt.ValidationErrorMalformed != 0 {
+		reasons = append(reasons, fmt.Sprintf("the token is malformed: %s", err))
+	}
+	if verr.Errors&jwt.ValidationErrorUnverifiable != 0 {
+		reasons = append(reasons, fmt.Sprintf("no configured key can verify the token: %s", err))
+	}
+	if verr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+		reasons = append(reasons, "the signature does not match the key selected by the kid and alg headers")
+	}
+	if verr.Errors&jwt.ValidationErrorExpired != 0 {
+		exp, _ := claims["exp"].(float64)
+		reasons = append(reasons, fmt.Sprintf("the token expired %s", relativeTime(time.Unix(int64(exp), 0))))
+	}
+	if verr.Errors&jwt.ValidationErrorNotValidYet != 0 {
+		nbf, _ := claims["nbf"].(float64)
+		reasons = append(reasons, fmt.Sprintf("the token is not valid until %s", time.Unix(int64(nbf), 0).Format(time.RFC3339)))
+	}
+	if len(reasons) == 0 {
+		return err.Error()
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func relativeTime(t time.Time) string {
+	d := time.Since(t) / time.Second * time.Second
+	if d < 0 {
+		return "in " + (-d).String()
+	}
+	return d.String() + " ago"
+}
+
+func printJSON(label string, value interface{}) {
+	body, _ := json.MarshalIndent(value, "", "  ")
+	fmt.Printf("%s: %s\n", label, body)
+}
+
+func rejectToken(status int, format string, args ...interface{}) {
+	fmt.Printf("Rejected with %d: %s\n", status, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Sign and inspect tokens",
+	Long:  `Signs tokens for testing the API, and explains why a token would be rejected`,
+}
+
+var tokenSignCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Sign a token with the configured key",
+	Long: `Signs a token granting avatars and scopes, with the JwtKey or the private
+key at JwtSigningKey (or --key). The token is printed on its own, i.e.:
+
+  curl -H "Authorization: Bearer $(avatar token sign --hash ...)" ...`,
+	Run: tokenSignRun,
+}
+
+var tokenInspectCmd = &cobra.Command{
+	Use:   "inspect TOKEN",
+	Short: "Decode a token and check it like the API does",
+	Long: `Decodes a token and goes through the checks of the API, explaining why it
+would be rejected. Pass --hash and --scope to check it for a request, i.e.
+--scope avatar:delete for DELETE /:hash. The exit status is 1 on rejection.`,
+	Run: tokenInspectRun,
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	urlCmd.Flags().String("size", "", "size to link to")
+	urlCmd.Flags().Duration("ttl", time.Hour, "how long the URL is valid")
+
+	RootCmd.AddCommand(urlCmd)
+}
+
+func urlRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalln("Pass the hash of the avatar to link to.")
+	}
+	if err := data.LoadConfig("config"); err != nil {
+		log.Println(err)
+	}
+
+	size, _ := cmd.Flags().GetString("size")
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+
+	hash, ok := data.NormalizeHash(args[0])
+	if !ok {
+		log.Fatalln("Not the hash of an avatar:", args[0])
+	}
+
+	url, err := data.SignAvatarURL(hash, size, time.Now().Add(ttl))
+	if err != nil {
+		log.Fatalln("Unable to sign the URL.", err)
+	}
+	fmt.Println(url)
+}
+
+var urlCmd = &cobra.Command{
+	Use:   "url HASH",
+	Short: "Print a signed URL of an avatar",
+	Long: `Prints the path of an avatar with a signature that lets it be read until
+it expires, even when the avatar is private. Prefix it with the address of
+the service.`,
+	Run: urlRun,
+}
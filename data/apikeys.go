@@ -0,0 +1,281 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// APIKeyHeader is the request header services send their API key in
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to search for
+const apiKeyPrefix = "avk"
+
+var (
+	// ErrAPIKeyNotFound is returned when no API key has the ID
+	ErrAPIKeyNotFound = errors.New("API key not found")
+
+	// ErrAPIKeyInvalid is returned for unknown keys and wrong secrets alike
+	ErrAPIKeyInvalid = errors.New("API key is invalid")
+)
+
+// APIKey lets a service change avatars without minting a token for every
+// request. Only a hash of the secret is kept.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash,omitempty"` // hex encoded SHA-256 of the secret
+	Scopes     []string   `json:"scopes"`
+	Tenant     string     `json:"tenant,omitempty"` // restricts the key to the avatars of a tenant
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Source     string     `json:"source" dynamo:"-"` // config or db
+}
+
+// Claims describes the key like the claims of a token, so both are
+// authorized the same way. Keys without a tenant grant every avatar.
+func (k *APIKey) Claims() map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":   "apikey:" + k.ID,
+		"scope": strings.Join(k.Scopes, " "),
+	}
+	if len(k.Tenant) > 0 {
+		claims["tenant"] = k.Tenant
+	} else {
+		claims["admin"] = true
+	}
+	return claims
+}
+
+// APIKeyStore is implemented by the stores that can keep API keys, used
+// when ApiKeyStore is db
+type APIKeyStore interface {
+	FindAPIKey(id string) (*APIKey, error)
+	SaveAPIKey(key *APIKey) error
+	DeleteAPIKey(id string) error
+	ListAPIKeys() ([]*APIKey, error)
+
+	// TouchAPIKey records when a key was last used
+	TouchAPIKey(id string, at time.Time) error
+}
+
+// AsAPIKeyStore returns the APIKeyStore of a DB, looking through any cache
+// wrapped around it.
+func AsAPIKeyStore(db DB) (APIKeyStore, bool) {
+	if cached, ok := db.(*CachedDB); ok {
+		db = cached.DB
+	}
+	keys, ok := db.(APIKeyStore)
+	return keys, ok
+}
+
+// NewAPIKey creates a key with a random secret, and returns it along with
+// the only copy of the key to hand out.
+func NewAPIKey(name string, scopes []string, tenant string) (*APIKey, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("an API key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if scope != ScopeWrite && scope != ScopeDelete && scope != ScopeIdentify {
+			return nil, "", fmt.Errorf("API keys can only have the %s, %s and %s scopes", ScopeWrite, ScopeDelete, ScopeIdentify)
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		ID:        id,
+		Name:      name,
+		Hash:      hashAPIKeySecret(secret),
+		Scopes:    scopes,
+		Tenant:    tenant,
+		CreatedAt: time.Now(),
+	}
+	return key, apiKeyPrefix + "_" + id + "_" + secret, nil
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAPIKey reads the ID and secret of a key
+func splitAPIKey(raw string) (string, string, bool) {
+	parts := strings.Split(raw, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// apiKeyTouchInterval limits how often the last use of a key is recorded
+const apiKeyTouchInterval = time.Minute
+
+// APIKeyRing holds the keys from the ApiKeys config, and looks up the keys
+// kept by the DB when ApiKeyStore is db. Keys from the config cannot be
+// changed, so their last use is only known to the running service.
+type APIKeyRing struct {
+	static map[string]*APIKey
+	store  APIKeyStore
+
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+// LoadAPIKeys loads the configured keys
+func LoadAPIKeys(db DB) (*APIKeyRing, error) {
+	r := &APIKeyRing{
+		static:   make(map[string]*APIKey),
+		lastUsed: make(map[string]time.Time),
+	}
+
+	var keys []*APIKey
+	if err := viper.UnmarshalKey("ApiKeys", &keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if len(key.ID) == 0 || len(key.Hash) == 0 {
+			return nil, fmt.Errorf("API key %q needs an id and a hash", key.Name)
+		}
+		key.Source = "config"
+		r.static[key.ID] = key
+	}
+
+	switch store := viper.GetString("ApiKeyStore"); store {
+	case "", "config":
+	case "db":
+		keys, ok := AsAPIKeyStore(db)
+		if !ok {
+			return nil, fmt.Errorf("the %s store cannot keep API keys", viper.GetString("Store"))
+		}
+		r.store = keys
+	default:
+		return nil, fmt.Errorf("unknown ApiKeyStore %q", store)
+	}
+
+	return r, nil
+}
+
+// Store returns where new keys are kept, or nil when they can only be added
+// to the config
+func (r *APIKeyRing) Store() APIKeyStore {
+	return r.store
+}
+
+// Verify finds the key and checks its secret, recording its use
+func (r *APIKeyRing) Verify(raw string) (*APIKey, error) {
+	id, secret, ok := splitAPIKey(raw)
+	if !ok {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	key, err := r.find(id)
+	if err == ErrAPIKeyNotFound {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(strings.ToLower(key.Hash))) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	r.touch(key)
+	return key, nil
+}
+
+func (r *APIKeyRing) find(id string) (*APIKey, error) {
+	if key, ok := r.static[id]; ok {
+		k := *key
+		return &k, nil
+	}
+	if r.store == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	key, err := r.store.FindAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+	key.Source = "db"
+	return key, nil
+}
+
+// touch records the use of a key, at most once per apiKeyTouchInterval
+func (r *APIKeyRing) touch(key *APIKey) {
+	now := time.Now()
+
+	r.mu.Lock()
+	if now.Sub(r.lastUsed[key.ID]) < apiKeyTouchInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastUsed[key.ID] = now
+	r.mu.Unlock()
+
+	key.LastUsedAt = &now
+	if key.Source == "db" {
+		if err := r.store.TouchAPIKey(key.ID, now); err != nil {
+			log.Println("Error recording the use of API key", key.ID, err)
+		}
+	}
+}
+
+// List returns every key without its hash, the ones from the config first
+func (r *APIKeyRing) List() ([]*APIKey, error) {
+	keys := make([]*APIKey, 0, len(r.static))
+
+	r.mu.Lock()
+	for _, key := range r.static {
+		k := *key
+		if at, ok := r.lastUsed[key.ID]; ok {
+			k.LastUsedAt = &at
+		}
+		keys = append(keys, &k)
+	}
+	r.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	if r.store != nil {
+		stored, err := r.store.ListAPIKeys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range stored {
+			key.Source = "db"
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		key.Hash = ""
+	}
+	return keys, nil
+}
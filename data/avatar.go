@@ -1,6 +1,9 @@
 package data
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"strconv"
 	"time"
@@ -13,11 +16,23 @@ type Sizes []string
 
 // Avatar stores the data for each object
 type Avatar struct {
-	Hash      string    `gorm:"type:varchar(40);not null;primary_key" json:"hash"` // hash identifier of the object
+	Hash      string    `gorm:"type:varchar(64);not null;primary_key" json:"hash"` // hash identifier of the object
 	Type      string    `gorm:"type:char(4);not null" json:"type"`                 // file extension of the avatar
 	Sizes     Sizes     `gorm:"-" sql:"-" json:"sizes"`                            // list of available sizes
+	Version   int       `gorm:"not null;default:0" json:"version"`                 // incremented on every upload
+	Revision  int       `gorm:"-" sql:"-" json:"revision,omitempty"`               // incremented on every save, to detect concurrent saves
 	CreatedAt time.Time `json:"createdAt"`                                         // when the avatar was first created
-	UpdatedAt time.Time `json:"updatedAt"`                                         // last update of the avatar
+	UpdatedAt time.Time `dynamo:"-" json:"updatedAt"`                              // last update of the avatar, see dynamoAvatar
+
+	Renditions   Renditions `gorm:"-" sql:"-" json:"renditions,omitempty"`               // stored file of each size
+	SourceWidth  int        `gorm:"not null;default:0" json:"sourceWidth,omitempty"`     // width of the uploaded image
+	SourceHeight int        `gorm:"not null;default:0" json:"sourceHeight,omitempty"`    // height of the uploaded image
+	Format       string     `gorm:"type:varchar(8);not null" json:"format,omitempty"`    // format the image was uploaded in
+	UploadedBy   string     `gorm:"type:text;not null" json:"uploadedBy,omitempty"`      // subject of the token used to upload
+	Color        string     `gorm:"type:varchar(7);not null" json:"color,omitempty"`     // dominant color as #rrggbb
+	Tenant       string     `gorm:"type:text;not null" json:"tenant,omitempty"`          // tenant of the token used to upload
+	Private      bool       `gorm:"not null;default:false" json:"private,omitempty"`     // only served through signed URLs
+	UploadID     string     `gorm:"type:varchar(16);not null" json:"uploadId,omitempty"` // random part of the file names of the version
 }
 
 func (Avatar) TableName() string {
@@ -29,13 +44,21 @@ func (Avatar) TableName() string {
 func FindAvatar(db DB, hash string) *Avatar {
 	avatar, err := db.FindByHash(hash)
 	if err != nil {
-		log.Printf("Error finding avatar %s %s", hash, err)
+		if err != ErrAvatarNotFound {
+			log.Printf("Error finding avatar %s %s", hash, err)
+		}
 		return nil
 	}
 
 	return avatar
 }
 
+// FindAvatarFresh is FindAvatar bypassing any cache, for reading an avatar
+// that is about to be changed
+func FindAvatarFresh(db DB, hash string) *Avatar {
+	return FindAvatar(Uncached(db), hash)
+}
+
 // Save the avatar to the database
 func (a *Avatar) Save(db DB) error {
 	err := db.Save(a)
@@ -47,10 +70,32 @@ func (a *Avatar) Save(db DB) error {
 	return nil
 }
 
-// GetURL gets the full URL of the avatar object for a given size, including
-// the S3 bucket path.
-func (a Avatar) GetURL(size string, bucket string) string {
-	return "//s3.amazonaws.com/" + bucket + "/" + a.GetPath(size)
+// DeleteAvatar removes an avatar along with its previous versions and all of
+// their files. The records go first, so nothing ever points at a removed
+// file. Files left behind by a failure are found by gc.
+func DeleteAvatar(app *Application, avatar Avatar) error {
+	versions, err := app.DB.FindVersions(avatar.Hash)
+	if err != nil {
+		return err
+	}
+
+	if err := app.DB.Delete(avatar.Hash); err != nil {
+		return err
+	}
+	if err := ClearAvatarFiles(app.Storage, avatar); err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if err := app.DB.DeleteVersion(version.Hash, version.Version); err != nil {
+			return err
+		}
+		if err := ClearAvatarFiles(app.Storage, *version); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // GetPath returns the path to the file object for a given size.
@@ -61,19 +106,86 @@ func (a Avatar) GetPath(size string) string {
 	return file[:1] + "/" + file[1:3] + "/" + file
 }
 
-// GetFilename generates the file name of the object for a given size.
+// GetMasterPath returns the path to the original upload the sizes were
+// derived from. Masters live under their own prefix as they are private.
+func (a Avatar) GetMasterPath() string {
+	return viper.GetString("MasterPrefix") + a.GetPath("master")
+}
+
+// GetFilename generates the file name of the object for a given size. Each
+// version gets its own file name so that the objects never change once
+// uploaded and can be cached indefinitely. The upload ID keeps two uploads
+// racing for the same version from writing the same files. Avatars uploaded
+// before versioning was introduced keep their original unversioned names.
 func (a Avatar) GetFilename(size string) string {
-	return a.Hash + "." + size + "." + a.Type
+	if a.Version == 0 {
+		return a.Hash + "." + size + "." + a.Type
+	}
+	version := ".v" + strconv.Itoa(a.Version)
+	if len(a.UploadID) > 0 {
+		version += "-" + a.UploadID
+	}
+	return a.Hash + version + "." + size + "." + a.Type
 }
 
-// BestSize determines the best size for the avatar, using the requested size
-// as a reference.
-func (a Avatar) BestSize(size string) string {
+// NewUploadID returns a random ID for the files of a new version
+func NewUploadID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ContentType returns the MIME type of the avatar files.
+func (a Avatar) ContentType() string {
+	if a.Type == "jpg" {
+		return "image/jpeg"
+	}
+	return "image/" + a.Type
+}
+
+// MatchesContentType determines if a stored file has the MIME type of the
+// avatar. Files uploaded by earlier releases may be labeled image/jpg.
+func (a Avatar) MatchesContentType(contentType string) bool {
+	return contentType == a.ContentType() || contentType == "image/"+a.Type
+}
+
+// ETag returns an entity tag that changes whenever the avatar is replaced.
+// It is derived from the version, as every upload increments it, rather
+// than from UpdatedAt, whose precision differs between the stores.
+func (a Avatar) ETag() string {
+	return fmt.Sprintf(`"%s-v%d"`, a.Hash, a.Version)
+}
+
+// HasSize determines if a file exists for the given size.
+func (a Avatar) HasSize(size string) bool {
 	for _, s := range a.Sizes {
 		if s == size {
-			return size
+			return true
 		}
 	}
+	return false
+}
+
+// LargestSize returns the largest size a file exists for.
+func (a Avatar) LargestSize() string {
+	largest := ""
+	for _, s := range a.Sizes {
+		if len(largest) == 0 || DefaultSizes[s] > DefaultSizes[largest] {
+			largest = s
+		}
+	}
+	return largest
+}
+
+// BestSize determines the best size for the avatar, using the requested size
+// as a reference. It is empty when the avatar has no sizes at all.
+func (a Avatar) BestSize(size string) string {
+	if a.HasSize(size) {
+		return size
+	}
+	if len(a.Sizes) == 0 {
+		return ""
+	}
 	return a.Sizes[len(a.Sizes)-1]
 }
 
@@ -0,0 +1,331 @@
+package data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+)
+
+var (
+	boltAvatars  = []byte("avatars")
+	boltVersions = []byte("versions")
+	boltTokens   = []byte("tokens")
+	boltAPIKeys  = []byte("apikeys")
+)
+
+// BoltDB stores the avatars in a local file, so the service can run as a
+// single process without a database server.
+type BoltDB struct {
+	db *bolt.DB
+
+	mu           sync.Mutex
+	tokensPruned time.Time
+}
+
+// Connect opens the database file
+func (b *BoltDB) Connect() error {
+	db, err := bolt.Open(viper.GetString("BoltPath"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	b.db = db
+
+	// The buckets are needed by commands that do not run the migrations
+	return b.Migrate()
+}
+
+func (b *BoltDB) FindByHash(hash string) (*Avatar, error) {
+	var avatar *Avatar
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltAvatars).Get([]byte(hash))
+		if value == nil {
+			return ErrAvatarNotFound
+		}
+		avatar = &Avatar{}
+		return json.Unmarshal(value, avatar)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return avatar, nil
+}
+
+// Save only replaces the avatar if nobody else saved it since it was read,
+// and returns ErrConflict otherwise.
+func (b *BoltDB) Save(a *Avatar) error {
+	saved := *a
+	touch(&saved)
+	saved.Revision++
+
+	value, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAvatars)
+
+		var stored Avatar
+		if current := bucket.Get([]byte(a.Hash)); current != nil {
+			if err := json.Unmarshal(current, &stored); err != nil {
+				return err
+			}
+		}
+		if stored.Revision != a.Revision {
+			return ErrConflict
+		}
+
+		return bucket.Put([]byte(a.Hash), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	*a = saved
+	return nil
+}
+
+func (b *BoltDB) Delete(hash string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAvatars).Delete([]byte(hash))
+	})
+}
+
+func (b *BoltDB) List(cursor string, limit int, filter ListFilter) ([]*Avatar, string, error) {
+	avatars := make([]*Avatar, 0, limit)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAvatars).Cursor()
+
+		key, value := c.Seek([]byte(cursor))
+		if key != nil && string(key) == cursor {
+			key, value = c.Next()
+		}
+
+		for ; key != nil && len(avatars) < limit; key, value = c.Next() {
+			avatar := &Avatar{}
+			if err := json.Unmarshal(value, avatar); err != nil {
+				return err
+			}
+			if filter.Matches(avatar) {
+				avatars = append(avatars, avatar)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(avatars) == limit {
+		next = avatars[len(avatars)-1].Hash
+	}
+
+	return avatars, next, nil
+}
+
+func (b *BoltDB) SaveVersion(a *Avatar) error {
+	value, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		versions, err := tx.Bucket(boltVersions).CreateBucketIfNotExists([]byte(a.Hash))
+		if err != nil {
+			return err
+		}
+		return versions.Put(boltVersionKey(a.Version), value)
+	})
+}
+
+func (b *BoltDB) FindVersions(hash string) ([]*Avatar, error) {
+	versions := []*Avatar{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltVersions).Bucket([]byte(hash))
+		if bucket == nil {
+			return nil
+		}
+
+		// Keys sort by version, so walk backwards for the newest first
+		c := bucket.Cursor()
+		for key, value := c.Last(); key != nil; key, value = c.Prev() {
+			avatar := &Avatar{}
+			if err := json.Unmarshal(value, avatar); err != nil {
+				return err
+			}
+			versions = append(versions, avatar)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (b *BoltDB) DeleteVersion(hash string, version int) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltVersions).Bucket([]byte(hash))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(boltVersionKey(version))
+	})
+}
+
+// UseToken records a used token ID along with its expiry, see TokenStore.
+// Expired IDs are dropped at most once per tokenPruneInterval.
+func (b *BoltDB) UseToken(jti string, expires time.Time) (bool, error) {
+	now := time.Now()
+	prune := b.pruneTokensDue(now)
+
+	fresh := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTokens)
+		if prune {
+			var expired [][]byte
+			bucket.ForEach(func(k, v []byte) error {
+				if boltTokenExpired(v, now) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		if v := bucket.Get([]byte(jti)); v != nil && !boltTokenExpired(v, now) {
+			return nil
+		}
+		fresh = true
+
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(expires.Unix()))
+		return bucket.Put([]byte(jti), value)
+	})
+
+	return fresh, err
+}
+
+// ReleaseToken forgets a used token ID, see TokenStore
+func (b *BoltDB) ReleaseToken(jti string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokens).Delete([]byte(jti))
+	})
+}
+
+func (b *BoltDB) pruneTokensDue(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.tokensPruned) < tokenPruneInterval {
+		return false
+	}
+	b.tokensPruned = now
+	return true
+}
+
+func boltTokenExpired(value []byte, now time.Time) bool {
+	return len(value) != 8 || int64(binary.BigEndian.Uint64(value)) < now.Unix()
+}
+
+func (b *BoltDB) Migrate() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltAvatars, boltVersions, boltTokens, boltAPIKeys} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltVersionKey encodes a version so that keys sort numerically
+func boltVersionKey(version int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+func (b *BoltDB) FindAPIKey(id string) (*APIKey, error) {
+	var key *APIKey
+	err := b.db.View(func(tx *bolt.Tx) error {
+		body := tx.Bucket(boltAPIKeys).Get([]byte(id))
+		if body == nil {
+			return ErrAPIKeyNotFound
+		}
+		return json.Unmarshal(body, &key)
+	})
+	return key, err
+}
+
+func (b *BoltDB) SaveAPIKey(key *APIKey) error {
+	body, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeys).Put([]byte(key.ID), body)
+	})
+}
+
+func (b *BoltDB) DeleteAPIKey(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAPIKeys)
+		if bucket.Get([]byte(id)) == nil {
+			return ErrAPIKeyNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (b *BoltDB) ListAPIKeys() ([]*APIKey, error) {
+	var keys []*APIKey
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeys).ForEach(func(k, v []byte) error {
+			var key *APIKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (b *BoltDB) TouchAPIKey(id string, at time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAPIKeys)
+		body := bucket.Get([]byte(id))
+		if body == nil {
+			return ErrAPIKeyNotFound
+		}
+
+		var key APIKey
+		if err := json.Unmarshal(body, &key); err != nil {
+			return err
+		}
+		key.LastUsedAt = &at
+
+		body, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), body)
+	})
+}
@@ -0,0 +1,34 @@
+package data_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/dolfelt/avatar-go/data/dbtest"
+	"github.com/spf13/viper"
+)
+
+func TestBoltDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatar-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every test gets its own file, as an open file is locked
+	var files int
+	dbtest.Run(t, func(t *testing.T) data.DB {
+		files++
+		viper.Set("BoltPath", filepath.Join(dir, fmt.Sprintf("avatars-%d.db", files)))
+
+		db := &data.BoltDB{}
+		if err := db.Connect(); err != nil {
+			t.Fatal("connect:", err)
+		}
+		return db
+	})
+}
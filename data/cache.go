@@ -0,0 +1,301 @@
+package data
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/spf13/viper"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheStats counts how lookups through a CachedDB were answered. They are
+// published with expvar under "cache".
+var cacheStats = expvar.NewMap("cache")
+
+// CacheStats returns the current value of every cache counter.
+func CacheStats() map[string]int64 {
+	stats := map[string]int64{
+		"hits":         0,
+		"negativeHits": 0,
+		"misses":       0,
+		"loads":        0,
+		"errors":       0,
+	}
+	cacheStats.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			stats[kv.Key] = v.Value()
+		}
+	})
+	return stats
+}
+
+// Cache keeps looked up avatars by hash. A nil avatar records that the hash
+// does not exist.
+type Cache interface {
+	// Get reports whether the hash is cached, and the avatar if there is one
+	Get(hash string) (*Avatar, bool)
+	Set(hash string, avatar *Avatar, ttl time.Duration)
+	Delete(hash string)
+}
+
+// CachedDB answers FindByHash from a cache before asking the wrapped DB.
+// Concurrent lookups of the same hash share a single query. Every write
+// through the CachedDB evicts the hash again, so only writes made around it,
+// or by other processes using an in-memory cache, are served stale until the
+// entry expires. Code about to change an avatar should read it through
+// Uncached, as a stale revision only makes the save fail.
+type CachedDB struct {
+	DB
+
+	Cache Cache
+
+	// How long found avatars and missing hashes are kept
+	TTL     time.Duration
+	MissTTL time.Duration
+
+	group singleflight.Group
+
+	mu      sync.Mutex
+	pending map[string]*pendingLoad
+}
+
+// pendingLoad counts the evictions of a hash while it is being loaded, so a
+// load that read the DB before a write does not cache what it read
+type pendingLoad struct {
+	loads     int
+	evictions int
+}
+
+// Uncached returns the DB wrapped by a cache, or the DB itself
+func Uncached(db DB) DB {
+	if cached, ok := db.(*CachedDB); ok {
+		return cached.DB
+	}
+	return db
+}
+
+func (c *CachedDB) FindByHash(hash string) (*Avatar, error) {
+	if avatar, ok := c.Cache.Get(hash); ok {
+		if avatar == nil {
+			cacheStats.Add("negativeHits", 1)
+			return nil, ErrAvatarNotFound
+		}
+		cacheStats.Add("hits", 1)
+		return avatar, nil
+	}
+	cacheStats.Add("misses", 1)
+
+	v, err, _ := c.group.Do(hash, func() (interface{}, error) {
+		cacheStats.Add("loads", 1)
+
+		evictions := c.startLoad(hash)
+		avatar, err := c.DB.FindByHash(hash)
+		switch err {
+		case nil:
+			c.Cache.Set(hash, copyAvatar(*avatar), c.TTL)
+		case ErrAvatarNotFound:
+			if c.MissTTL > 0 {
+				c.Cache.Set(hash, nil, c.MissTTL)
+			}
+		default:
+			cacheStats.Add("errors", 1)
+		}
+
+		// Evicted while loading, so what was cached may predate the write
+		if c.finishLoad(hash, evictions) {
+			c.Cache.Delete(hash)
+		}
+		return avatar, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Callers sharing the query must not see each other's changes
+	return copyAvatar(*v.(*Avatar)), nil
+}
+
+func (c *CachedDB) Save(a *Avatar) error {
+	defer c.evict(a.Hash)
+	return c.DB.Save(a)
+}
+
+func (c *CachedDB) Delete(hash string) error {
+	defer c.evict(hash)
+	return c.DB.Delete(hash)
+}
+
+// evict drops the cached avatar. Loads in flight are marked before the entry
+// is deleted, so they either see the mark or are cached before the delete.
+func (c *CachedDB) evict(hash string) {
+	c.mu.Lock()
+	if p, ok := c.pending[hash]; ok {
+		p.evictions++
+	}
+	c.mu.Unlock()
+
+	c.group.Forget(hash)
+	c.Cache.Delete(hash)
+}
+
+// startLoad registers a load of the hash and returns the evictions so far
+func (c *CachedDB) startLoad(hash string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == nil {
+		c.pending = make(map[string]*pendingLoad)
+	}
+	p, ok := c.pending[hash]
+	if !ok {
+		p = &pendingLoad{}
+		c.pending[hash] = p
+	}
+	p.loads++
+	return p.evictions
+}
+
+// finishLoad reports whether the hash was evicted since the load started
+func (c *CachedDB) finishLoad(hash string, evictions int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.pending[hash]
+	p.loads--
+	if p.loads == 0 {
+		delete(c.pending, hash)
+	}
+	return p.evictions != evictions
+}
+
+// MemoryCache is a size bounded cache that evicts the least recently used
+// avatars first. The zero value holds no entries at all.
+type MemoryCache struct {
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type memoryCacheEntry struct {
+	hash    string
+	avatar  *Avatar
+	expires time.Time
+}
+
+func (m *MemoryCache) Get(hash string) (*Avatar, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[hash]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		m.remove(el)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+
+	if entry.avatar == nil {
+		return nil, true
+	}
+	return copyAvatar(*entry.avatar), true
+}
+
+func (m *MemoryCache) Set(hash string, avatar *Avatar, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Size <= 0 {
+		return
+	}
+	if m.entries == nil {
+		m.entries = make(map[string]*list.Element)
+		m.order = list.New()
+	}
+
+	entry := &memoryCacheEntry{hash: hash, avatar: avatar, expires: time.Now().Add(ttl)}
+	if el, ok := m.entries[hash]; ok {
+		el.Value = entry
+		m.order.MoveToFront(el)
+		return
+	}
+
+	m.entries[hash] = m.order.PushFront(entry)
+	for m.order.Len() > m.Size {
+		m.remove(m.order.Back())
+	}
+}
+
+func (m *MemoryCache) Delete(hash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[hash]; ok {
+		m.remove(el)
+	}
+}
+
+func (m *MemoryCache) remove(el *list.Element) {
+	delete(m.entries, el.Value.(*memoryCacheEntry).hash)
+	m.order.Remove(el)
+}
+
+// RedisCache keeps the avatars in Redis, so all instances of the service
+// share the cache and see each other's evictions.
+type RedisCache struct {
+	client *redis.Client
+}
+
+// Connect opens the connection to the configured Redis server
+func (r *RedisCache) Connect() error {
+	r.client = newRedisClient()
+	return r.client.Ping().Err()
+}
+
+func newRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     viper.GetString("RedisAddr"),
+		Password: viper.GetString("RedisPassword"),
+		DB:       viper.GetInt("RedisDB"),
+	})
+}
+
+// A cache failure only costs a database query, so errors are not reported
+
+func (r *RedisCache) Get(hash string) (*Avatar, bool) {
+	body, err := r.client.Get(r.key(hash)).Bytes()
+	if err != nil {
+		return nil, false
+	}
+
+	var avatar *Avatar
+	if err := json.Unmarshal(body, &avatar); err != nil {
+		return nil, false
+	}
+	return avatar, true
+}
+
+func (r *RedisCache) Set(hash string, avatar *Avatar, ttl time.Duration) {
+	body, err := json.Marshal(avatar)
+	if err != nil {
+		return
+	}
+	r.client.Set(r.key(hash), body, ttl)
+}
+
+func (r *RedisCache) Delete(hash string) {
+	r.client.Del(r.key(hash))
+}
+
+func (r *RedisCache) key(hash string) string {
+	return viper.GetString("RedisPrefix") + hash
+}
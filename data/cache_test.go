@@ -0,0 +1,73 @@
+package data_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+)
+
+// pausedDB holds the first lookup after it has read the avatar, until it is
+// released
+type pausedDB struct {
+	*data.MemoryDB
+
+	once     sync.Once
+	read     chan struct{}
+	released chan struct{}
+}
+
+func (p *pausedDB) FindByHash(hash string) (*data.Avatar, error) {
+	avatar, err := p.MemoryDB.FindByHash(hash)
+	p.once.Do(func() {
+		close(p.read)
+		<-p.released
+	})
+	return avatar, err
+}
+
+func TestCachedDBLoadDuringSave(t *testing.T) {
+	db := &pausedDB{MemoryDB: &data.MemoryDB{}, read: make(chan struct{}), released: make(chan struct{})}
+	cached := &data.CachedDB{DB: db, Cache: &data.MemoryCache{Size: 10}, TTL: time.Minute, MissTTL: time.Minute}
+
+	avatar := &data.Avatar{Hash: "0123456789abcdef0123456789abcdef01234567", Type: "png", Version: 1, Sizes: []string{"small"}}
+	if err := cached.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	loaded := make(chan struct{})
+	go func() {
+		cached.FindByHash(avatar.Hash)
+		close(loaded)
+	}()
+
+	// The load has read version 1 when version 2 is saved
+	<-db.read
+	avatar.Version = 2
+	if err := cached.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+	close(db.released)
+	<-loaded
+
+	found, err := cached.FindByHash(avatar.Hash)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	if found.Version != 2 {
+		t.Errorf("Version = %d, the load cached what it read before the save", found.Version)
+	}
+}
+
+func TestUncached(t *testing.T) {
+	db := &data.MemoryDB{}
+	cached := &data.CachedDB{DB: db, Cache: &data.MemoryCache{Size: 10}, TTL: time.Minute}
+
+	if data.Uncached(cached) != db {
+		t.Error("Uncached did not unwrap the cache")
+	}
+	if data.Uncached(db) != db {
+		t.Error("Uncached changed a DB without a cache")
+	}
+}
@@ -13,10 +13,22 @@ var DefaultAvatar *Avatar
 
 // Application holds all the info for the app
 type Application struct {
-	DB    DB
-	Debug bool
+	DB         DB
+	Storage    Storage
+	Keys       *KeySet
+	Tokens     TokenStore // nil unless tokens are single use
+	APIKeys    *APIKeyRing
+	AuthPolicy string
+	Debug      bool
 }
 
+// Policies for the token checks of the endpoints changing avatars
+const (
+	AuthPolicyRequired            = "required"              // every request needs a token
+	AuthPolicyDisabled            = "disabled"              // no request needs a token
+	AuthPolicyDisabledForLoopback = "disabled-for-loopback" // requests from the host itself need none
+)
+
 // LoadConfig loads external configuration file
 func LoadConfig(path string) error {
 	viper.AutomaticEnv()
@@ -33,6 +45,9 @@ func LoadConfig(path string) error {
 	}
 
 	loadDefaultSettings()
+	if err := checkHashAlgorithms(); err != nil {
+		return err
+	}
 
 	DefaultAvatar = &Avatar{
 		Hash:  viper.GetString("DefaultAvatar.Hash"),
@@ -53,20 +68,63 @@ func loadDefaultSettings() {
 
 	// DynamoDB Config
 	viper.SetDefault("DynamoRegion", "us-east-1")
+	viper.SetDefault("DynamoReadCapacity", 5)
+	viper.SetDefault("DynamoWriteCapacity", 5)
+	viper.SetDefault("DynamoIndexes", false)
+	viper.SetDefault("DynamoVersionTTL", 0)
+
+	// Embedded database config
+	viper.SetDefault("BoltPath", "avatars.db")
 
 	// S3 Storage Config
 	viper.SetDefault("AwsBucketRegion", "us-east-1")
 
+	// Local disk storage config
+	viper.SetDefault("StoragePath", "files")
+	viper.SetDefault("MasterPrefix", "masters/")
+
 	// Default avatar settings
 	viper.SetDefault("DefaultAvatar.Hash", "7505d64a54e061b7acd54ccd58b49dc43500b635")
 	viper.SetDefault("DefaultAvatar.Type", "png")
 	viper.SetDefault("DefaultAvatar.Sizes", DefaultSizeKeys())
 
+	// Caching and delivery of avatar files
+	viper.SetDefault("ReadProxy", false)
+	viper.SetDefault("CacheControl", "public")
+	viper.SetDefault("RedirectMaxAge", 300)
+	viper.SetDefault("ProxyMaxAge", 86400)
+	viper.SetDefault("ImmutableCacheControl", "public, max-age=31536000, immutable")
+
+	// Cache in front of the database lookups
+	viper.SetDefault("Cache", "none")
+	viper.SetDefault("CacheSize", 10000)
+	viper.SetDefault("CacheTTL", "1m")
+	viper.SetDefault("CacheMissTTL", "5s")
+	viper.SetDefault("RedisAddr", "localhost:6379")
+	viper.SetDefault("RedisPrefix", "avatar:")
+
+	// Token verification
+	viper.SetDefault("JwtJwksRefresh", "1h")
+	viper.SetDefault("JwtLegacyTokens", false)
+	viper.SetDefault("JwtRequireExp", false)
+	viper.SetDefault("JwtRequireJti", false)
+	viper.SetDefault("JwtReplayStore", "none")
+
+	viper.SetDefault("AuthPolicy", AuthPolicyRequired)
+	viper.SetDefault("ApiKeyStore", "config")
+	viper.SetDefault("AllowAuthDisabled", false)
+
 	viper.SetDefault("Port", 3000)
 	viper.SetDefault("Debug", false)
+	viper.SetDefault("HashAlgorithms", []string{"sha1"})
 	viper.SetDefault("TableName", "avatars")
+	viper.SetDefault("VersionTableName", viper.GetString("TableName")+"_versions")
+	viper.SetDefault("TokenTableName", viper.GetString("TableName")+"_tokens")
+	viper.SetDefault("ApiKeyTableName", viper.GetString("TableName")+"_api_keys")
+	viper.SetDefault("VersionRetention", 5)
 
 	viper.SetDefault("Store", "postgres")
+	viper.SetDefault("Storage", "s3")
 }
 
 // DefaultSizes is the list of sizes
@@ -95,6 +153,16 @@ func (e *AppError) Error() string {
 	return e.msg
 }
 
+// ImageError reports an upload that is not a usable image, as opposed to a
+// failure to store it
+type ImageError struct {
+	Err error
+}
+
+func (e *ImageError) Error() string {
+	return "invalid image: " + e.Err.Error()
+}
+
 // MinInt is a shim for determining the minimum for integers rather than floats
 func MinInt(x, y int) int {
 	if x > y {
@@ -1,8 +1,71 @@
 package data
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrAvatarNotFound is returned by a DB when no avatar matches a hash
+var ErrAvatarNotFound = errors.New("avatar not found")
+
+// ErrConflict is returned by a DB when an avatar was saved by someone else
+// after it was read
+var ErrConflict = errors.New("avatar was changed concurrently")
+
+// DB stores the avatar records. The behavior all implementations share is
+// verified by the dbtest package.
 type DB interface {
 	Connect() error
 	FindByHash(string) (*Avatar, error)
-	Save(*Avatar) error
 	Migrate() error
+
+	// Save creates or replaces an avatar. CreatedAt is filled in when it is
+	// zero, and UpdatedAt is always set to the current time. The Revision
+	// must still be the one the avatar was read with, 0 for a new avatar,
+	// or ErrConflict is returned. It is incremented once saved.
+	Save(*Avatar) error
+
+	// Delete removes an avatar. Deleting a missing avatar is not an error.
+	Delete(string) error
+
+	// List pages through the avatars matching the filter. It returns the
+	// cursor of the next page, which is empty once the last page has been
+	// read.
+	List(cursor string, limit int, filter ListFilter) ([]*Avatar, string, error)
+
+	// Previous versions of an avatar, listed from newest to oldest
+	SaveVersion(*Avatar) error
+	FindVersions(string) ([]*Avatar, error)
+	DeleteVersion(string, int) error
+}
+
+// ListFilter narrows down the avatars returned by List. Zero fields match
+// every avatar.
+type ListFilter struct {
+	UpdatedSince time.Time
+	Type         string
+	Tenant       string
+}
+
+// Matches determines if an avatar passes the filter
+func (f ListFilter) Matches(a *Avatar) bool {
+	if !f.UpdatedSince.IsZero() && a.UpdatedAt.Before(f.UpdatedSince) {
+		return false
+	}
+	if len(f.Type) > 0 && a.Type != f.Type {
+		return false
+	}
+	if len(f.Tenant) > 0 && a.Tenant != f.Tenant {
+		return false
+	}
+	return true
+}
+
+// touch sets the timestamps of an avatar that is about to be saved
+func touch(a *Avatar) {
+	now := time.Now()
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = now
+	}
+	a.UpdatedAt = now
 }
@@ -0,0 +1,580 @@
+// Package dbtest is a conformance suite for implementations of data.DB.
+//
+// Every implementation is expected to pass it, so callers can rely on the
+// same behavior no matter which store is configured:
+//
+//	func TestPostgresDB(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) data.DB {
+//			db := &data.PostgresDB{}
+//			if err := db.Connect(); err != nil {
+//				t.Skip("postgres is not available:", err)
+//			}
+//			db.Migrate()
+//			return db
+//		})
+//	}
+package dbtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+)
+
+// precision is how far timestamps may drift when stored, as not every store
+// keeps nanoseconds
+const precision = time.Millisecond
+
+// Run tests a DB against the behavior every implementation must share.
+// newDB is called for each test and must return a connected and migrated
+// DB. Every test uses its own random hashes, so the DB does not need to be
+// empty.
+func Run(t *testing.T, newDB func(t *testing.T) data.DB) {
+	tests := []struct {
+		name string
+		test func(*testing.T, data.DB)
+	}{
+		{"Create", testCreate},
+		{"Update", testUpdate},
+		{"NotFound", testNotFound},
+		{"Delete", testDelete},
+		{"List", testList},
+		{"ListFilter", testListFilter},
+		{"ListSubSecond", testListSubSecond},
+		{"ConcurrentSaves", testConcurrentSaves},
+		{"Revisions", testRevisions},
+		{"Timestamps", testTimestamps},
+		{"Versions", testVersions},
+		{"UsedTokens", testUsedTokens},
+		{"APIKeys", testAPIKeys},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			test(t, newDB(t))
+		})
+	}
+}
+
+func testCreate(t *testing.T, db data.DB) {
+	avatar := newAvatar()
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	found, err := db.FindByHash(avatar.Hash)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	assertAvatar(t, found, avatar)
+}
+
+func testUpdate(t *testing.T, db data.DB) {
+	avatar := newAvatar()
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	avatar.Type = "png"
+	avatar.Sizes = data.Sizes{"small"}
+	avatar.Version = 2
+	avatar.Private = false
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("update:", err)
+	}
+
+	found, err := db.FindByHash(avatar.Hash)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	assertAvatar(t, found, avatar)
+}
+
+func testNotFound(t *testing.T, db data.DB) {
+	found, err := db.FindByHash(randomHash())
+	if err != data.ErrAvatarNotFound {
+		t.Fatalf("expected ErrAvatarNotFound, got %v", err)
+	}
+	if found != nil {
+		t.Fatalf("expected no avatar, got %+v", found)
+	}
+}
+
+func testDelete(t *testing.T, db data.DB) {
+	avatar := newAvatar()
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	if err := db.Delete(avatar.Hash); err != nil {
+		t.Fatal("delete:", err)
+	}
+	if _, err := db.FindByHash(avatar.Hash); err != data.ErrAvatarNotFound {
+		t.Fatalf("expected ErrAvatarNotFound after delete, got %v", err)
+	}
+
+	if err := db.Delete(avatar.Hash); err != nil {
+		t.Fatal("deleting a missing avatar:", err)
+	}
+}
+
+func testList(t *testing.T, db data.DB) {
+	saved := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		avatar := newAvatar()
+		if err := db.Save(avatar); err != nil {
+			t.Fatal("save:", err)
+		}
+		saved[avatar.Hash] = true
+	}
+
+	seen := make(map[string]bool)
+	cursor := ""
+	for {
+		avatars, next, err := db.List(cursor, 2, data.ListFilter{})
+		if err != nil {
+			t.Fatal("list:", err)
+		}
+		if len(avatars) > 2 {
+			t.Fatalf("expected at most 2 avatars per page, got %d", len(avatars))
+		}
+
+		for _, avatar := range avatars {
+			if seen[avatar.Hash] {
+				t.Fatalf("avatar %s was listed twice", avatar.Hash)
+			}
+			seen[avatar.Hash] = true
+		}
+
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	for hash := range saved {
+		if !seen[hash] {
+			t.Errorf("avatar %s was not listed", hash)
+		}
+	}
+}
+
+func testListFilter(t *testing.T, db data.DB) {
+	tenant := randomHash()
+
+	old := newAvatar()
+	old.Tenant = tenant
+	if err := db.Save(old); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	since := time.Now()
+	time.Sleep(10 * precision)
+
+	recent := newAvatar()
+	recent.Tenant = tenant
+	recent.Type = "png"
+	if err := db.Save(recent); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	// Another tenant must never show up
+	if err := db.Save(newAvatar()); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	assertListed(t, db, data.ListFilter{Tenant: tenant}, old.Hash, recent.Hash)
+	assertListed(t, db, data.ListFilter{Tenant: tenant, Type: "png"}, recent.Hash)
+	assertListed(t, db, data.ListFilter{Tenant: tenant, UpdatedSince: since}, recent.Hash)
+}
+
+// testListSubSecond filters by times within the second an avatar was saved
+// in. Stores keeping times as text must compare them as times, where i.e.
+// 12:00:00.5 is later than 12:00:00.
+func testListSubSecond(t *testing.T, db data.DB) {
+	tenant := randomHash()
+
+	avatar := newAvatar()
+	avatar.Tenant = tenant
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	since := avatar.UpdatedAt.Truncate(time.Second)
+	assertListed(t, db, data.ListFilter{Tenant: tenant, UpdatedSince: since}, avatar.Hash)
+	assertListed(t, db, data.ListFilter{Tenant: tenant, Type: avatar.Type, UpdatedSince: since}, avatar.Hash)
+
+	assertListed(t, db, data.ListFilter{Tenant: tenant, UpdatedSince: avatar.UpdatedAt.Add(time.Second)})
+}
+
+// assertListed pages through the filtered avatars one at a time
+func assertListed(t *testing.T, db data.DB, filter data.ListFilter, expected ...string) {
+	listed := make(map[string]bool)
+	cursor := ""
+	for {
+		avatars, next, err := db.List(cursor, 1, filter)
+		if err != nil {
+			t.Fatal("list:", err)
+		}
+		for _, avatar := range avatars {
+			listed[avatar.Hash] = true
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	if len(listed) != len(expected) {
+		t.Fatalf("expected %v to list %v, got %v", filter, expected, listed)
+	}
+	for _, hash := range expected {
+		if !listed[hash] {
+			t.Fatalf("expected %v to list %v, got %v", filter, expected, listed)
+		}
+	}
+}
+
+func testConcurrentSaves(t *testing.T, db data.DB) {
+	hash := randomHash()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 1; i <= 10; i++ {
+		// Saves of the same new avatar must not collide. Stores tracking
+		// the revision let only one of them through.
+		wg.Add(1)
+		go func(version int) {
+			defer wg.Done()
+			avatar := newAvatar()
+			avatar.Hash = hash
+			avatar.Version = version
+			errs <- db.Save(avatar)
+		}(i)
+
+		// Saves of different avatars must not interfere
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.Save(newAvatar())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil && err != data.ErrConflict {
+			t.Error("concurrent save:", err)
+		}
+	}
+
+	found, err := db.FindByHash(hash)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	if found.Version < 1 || found.Version > 10 {
+		t.Fatalf("expected one of the saved versions, got %d", found.Version)
+	}
+}
+
+func testRevisions(t *testing.T, db data.DB) {
+	avatar := newAvatar()
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+	stale := *avatar
+
+	avatar.Version = 2
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("update:", err)
+	}
+
+	// Saves based on what was read before the update must not replace it
+	stale.Version = 3
+	if err := db.Save(&stale); err != data.ErrConflict {
+		t.Fatalf("expected ErrConflict saving a stale avatar, got %v", err)
+	}
+	fresh := newAvatar()
+	fresh.Hash = avatar.Hash
+	fresh.Version = 3
+	if err := db.Save(fresh); err != data.ErrConflict {
+		t.Fatalf("expected ErrConflict creating an existing avatar, got %v", err)
+	}
+
+	found, err := db.FindByHash(avatar.Hash)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	assertAvatar(t, found, avatar)
+	if found.Revision != avatar.Revision {
+		t.Fatalf("expected revision %d, got %d", avatar.Revision, found.Revision)
+	}
+}
+
+func testTimestamps(t *testing.T, db data.DB) {
+	before := time.Now().Add(-precision)
+
+	avatar := newAvatar()
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("save:", err)
+	}
+	if avatar.CreatedAt.Before(before) || avatar.UpdatedAt.Before(before) {
+		t.Fatalf("expected timestamps to be set on save, got %v and %v", avatar.CreatedAt, avatar.UpdatedAt)
+	}
+
+	created := avatar.CreatedAt
+	updated := avatar.UpdatedAt
+	time.Sleep(10 * time.Millisecond)
+
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("update:", err)
+	}
+	if !avatar.UpdatedAt.After(updated) {
+		t.Fatalf("expected UpdatedAt to move past %v, got %v", updated, avatar.UpdatedAt)
+	}
+
+	found, err := db.FindByHash(avatar.Hash)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	assertTime(t, "CreatedAt", found.CreatedAt, created)
+	assertTime(t, "UpdatedAt", found.UpdatedAt, avatar.UpdatedAt)
+
+	// An explicit creation time is kept, i.e. when replacing an avatar
+	past := time.Now().Add(-time.Hour)
+	avatar.CreatedAt = past
+	if err := db.Save(avatar); err != nil {
+		t.Fatal("update:", err)
+	}
+	found, err = db.FindByHash(avatar.Hash)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	assertTime(t, "CreatedAt", found.CreatedAt, past)
+}
+
+func testVersions(t *testing.T, db data.DB) {
+	hash := randomHash()
+
+	versions, err := db.FindVersions(hash)
+	if err != nil {
+		t.Fatal("find versions:", err)
+	}
+	if len(versions) != 0 {
+		t.Fatalf("expected no versions, got %d", len(versions))
+	}
+
+	for _, version := range []int{1, 3, 2} {
+		avatar := newAvatar()
+		avatar.Hash = hash
+		avatar.Version = version
+		if err := db.SaveVersion(avatar); err != nil {
+			t.Fatal("save version:", err)
+		}
+	}
+
+	assertVersions(t, db, hash, 3, 2, 1)
+
+	if err := db.DeleteVersion(hash, 2); err != nil {
+		t.Fatal("delete version:", err)
+	}
+	assertVersions(t, db, hash, 3, 1)
+}
+
+func assertVersions(t *testing.T, db data.DB, hash string, expected ...int) {
+	versions, err := db.FindVersions(hash)
+	if err != nil {
+		t.Fatal("find versions:", err)
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("expected %d versions, got %d", len(expected), len(versions))
+	}
+	for i, version := range versions {
+		if version.Version != expected[i] {
+			t.Fatalf("expected version %d at %d, got %d", expected[i], i, version.Version)
+		}
+	}
+}
+
+// testUsedTokens applies to the stores that implement data.TokenStore
+func testUsedTokens(t *testing.T, db data.DB) {
+	tokens, ok := data.AsTokenStore(db)
+	if !ok {
+		t.Skip("the store does not record used tokens")
+	}
+
+	jti := randomHash()
+	expires := time.Now().Add(time.Hour)
+
+	var wg sync.WaitGroup
+	fresh := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := tokens.UseToken(jti, expires)
+			if err != nil {
+				t.Error("use token:", err)
+			}
+			fresh <- ok
+		}()
+	}
+	wg.Wait()
+	close(fresh)
+
+	accepted := 0
+	for ok := range fresh {
+		if ok {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("expected the token to be accepted once, got %d", accepted)
+	}
+
+	// A released ID can be used once more
+	if err := tokens.ReleaseToken(jti); err != nil {
+		t.Fatal("release token:", err)
+	}
+	if ok, err := tokens.UseToken(jti, expires); err != nil || !ok {
+		t.Fatal("use of released token:", ok, err)
+	}
+	if ok, err := tokens.UseToken(jti, expires); err != nil || ok {
+		t.Fatal("reuse of released token:", ok, err)
+	}
+
+	// The ID of an expired token is free again
+	expired := randomHash()
+	if ok, err := tokens.UseToken(expired, time.Now().Add(-time.Minute)); err != nil || !ok {
+		t.Fatal("first use of expired token:", ok, err)
+	}
+	if ok, err := tokens.UseToken(expired, time.Now().Add(time.Hour)); err != nil || !ok {
+		t.Fatal("reuse of expired token ID:", ok, err)
+	}
+}
+
+// testAPIKeys applies to the stores that implement data.APIKeyStore
+func testAPIKeys(t *testing.T, db data.DB) {
+	keys, ok := data.AsAPIKeyStore(db)
+	if !ok {
+		t.Skip("the store does not keep API keys")
+	}
+
+	key, _, err := data.NewAPIKey("test", []string{data.ScopeWrite, data.ScopeDelete}, "tenant-"+randomHash())
+	if err != nil {
+		t.Fatal("new key:", err)
+	}
+	if err := keys.SaveAPIKey(key); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	found, err := keys.FindAPIKey(key.ID)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	if found.Hash != key.Hash || found.Tenant != key.Tenant || len(found.Scopes) != 2 || found.LastUsedAt != nil {
+		t.Fatalf("expected %+v, got %+v", key, found)
+	}
+
+	used := time.Now()
+	if err := keys.TouchAPIKey(key.ID, used); err != nil {
+		t.Fatal("touch:", err)
+	}
+	found, err = keys.FindAPIKey(key.ID)
+	if err != nil {
+		t.Fatal("find:", err)
+	}
+	if found.LastUsedAt == nil {
+		t.Fatal("expected the last use to be recorded")
+	}
+	assertTime(t, "LastUsedAt", *found.LastUsedAt, used)
+
+	listed, err := keys.ListAPIKeys()
+	if err != nil {
+		t.Fatal("list:", err)
+	}
+	seen := false
+	for _, k := range listed {
+		seen = seen || k.ID == key.ID
+	}
+	if !seen {
+		t.Fatal("expected the key to be listed")
+	}
+
+	if err := keys.DeleteAPIKey(key.ID); err != nil {
+		t.Fatal("delete:", err)
+	}
+	if _, err := keys.FindAPIKey(key.ID); err != data.ErrAPIKeyNotFound {
+		t.Fatal("expected the key to be gone, got", err)
+	}
+	if err := keys.DeleteAPIKey(key.ID); err != data.ErrAPIKeyNotFound {
+		t.Fatal("expected a second delete to fail, got", err)
+	}
+}
+
+func assertAvatar(t *testing.T, found *data.Avatar, expected *data.Avatar) {
+	if found.Hash != expected.Hash || found.Type != expected.Type || found.Version != expected.Version {
+		t.Fatalf("expected %+v, got %+v", expected, found)
+	}
+	if len(found.Sizes) != len(expected.Sizes) {
+		t.Fatalf("expected sizes %v, got %v", expected.Sizes, found.Sizes)
+	}
+	for i := range found.Sizes {
+		if found.Sizes[i] != expected.Sizes[i] {
+			t.Fatalf("expected sizes %v, got %v", expected.Sizes, found.Sizes)
+		}
+	}
+	if found.SourceWidth != expected.SourceWidth || found.SourceHeight != expected.SourceHeight ||
+		found.Format != expected.Format || found.UploadedBy != expected.UploadedBy || found.Color != expected.Color ||
+		found.Tenant != expected.Tenant || found.Private != expected.Private || found.UploadID != expected.UploadID {
+		t.Fatalf("expected %+v, got %+v", expected, found)
+	}
+	if len(found.Renditions) != len(expected.Renditions) {
+		t.Fatalf("expected renditions %v, got %v", expected.Renditions, found.Renditions)
+	}
+	for size, rendition := range expected.Renditions {
+		if found.Renditions[size] != rendition {
+			t.Fatalf("expected renditions %v, got %v", expected.Renditions, found.Renditions)
+		}
+	}
+}
+
+func assertTime(t *testing.T, name string, found time.Time, expected time.Time) {
+	diff := found.Sub(expected)
+	if diff < -precision || diff > precision {
+		t.Fatalf("expected %s %v, got %v", name, expected, found)
+	}
+}
+
+func newAvatar() *data.Avatar {
+	avatar := &data.Avatar{
+		Hash:         randomHash(),
+		Type:         "jpg",
+		Sizes:        data.Sizes{"small", "medium"},
+		Version:      1,
+		SourceWidth:  640,
+		SourceHeight: 480,
+		Format:       "jpeg",
+		UploadedBy:   "dbtest",
+		Color:        "#336699",
+		Tenant:       "dbtest",
+		Private:      true,
+		UploadID:     data.NewUploadID(),
+	}
+	avatar.Renditions = data.Renditions{
+		"small":  {Key: avatar.GetPath("small"), Width: 128, Height: 128, Bytes: 4096, Checksum: randomHash()},
+		"medium": {Key: avatar.GetPath("medium"), Width: 256, Height: 256, Bytes: 16384, Checksum: randomHash()},
+	}
+	return avatar
+}
+
+func randomHash() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
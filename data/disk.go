@@ -0,0 +1,185 @@
+package data
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// errStopWalk ends a directory walk early
+var errStopWalk = errors.New("stop walking")
+
+// DiskStorage stores the avatar files in a local directory. The files have
+// no public URL, so they are always served through the service.
+type DiskStorage struct {
+	root string
+}
+
+// Connect makes sure the configured directory exists
+func (d *DiskStorage) Connect() error {
+	root, err := filepath.Abs(viper.GetString("StoragePath"))
+	if err != nil {
+		return err
+	}
+
+	d.root = root
+	return os.MkdirAll(d.root, 0755)
+}
+
+func (d *DiskStorage) Put(key string, body io.Reader, opts PutOptions) error {
+	file, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see partial files
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func (d *DiskStorage) Get(key string) (io.ReadCloser, *StoredObject, error) {
+	obj, err := d.Stat(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, _ := d.path(key)
+	body, err := os.Open(file)
+	if err != nil {
+		return nil, nil, diskError(err)
+	}
+
+	return body, obj, nil
+}
+
+func (d *DiskStorage) Stat(key string) (*StoredObject, error) {
+	file, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, diskError(err)
+	}
+
+	return &StoredObject{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+	}, nil
+}
+
+func (d *DiskStorage) Copy(from string, to string, opts PutOptions) error {
+	body, _, err := d.Get(from)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return d.Put(to, body, opts)
+}
+
+func (d *DiskStorage) Delete(key string) error {
+	file, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *DiskStorage) List(prefix string, fn func(StoredObject) bool) error {
+	// Only walk the directory the prefix points into
+	dir, err := d.path(path.Dir(prefix))
+	if err != nil {
+		dir = d.root
+	}
+
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		next := fn(StoredObject{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+			ContentType:  mime.TypeByExtension(path.Ext(key)),
+		})
+		if !next {
+			return errStopWalk
+		}
+		return nil
+	})
+
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+func (d *DiskStorage) URL(key string) string {
+	return ""
+}
+
+// path maps a key to a file, making sure it stays inside the directory
+func (d *DiskStorage) path(key string) (string, error) {
+	file := filepath.Join(d.root, filepath.FromSlash(key))
+	if file != d.root && !strings.HasPrefix(file, d.root+string(filepath.Separator)) {
+		return "", &AppError{"invalid file key " + key}
+	}
+	return file, nil
+}
+
+func diskError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
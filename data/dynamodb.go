@@ -2,10 +2,15 @@ package data
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/gin-gonic/gin"
 	"github.com/guregu/dynamo"
 	"github.com/spf13/viper"
@@ -41,30 +46,498 @@ func (d *DynamoDB) Connect() error {
 	return nil
 }
 
+// dynamoTimeLayout has a fixed width, so update times stored as strings sort
+// and compare the same as the times themselves
+const dynamoTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// dynamoTime is a time stored in the dynamoTimeLayout
+type dynamoTime time.Time
+
+func (t dynamoTime) MarshalDynamo() (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{S: aws.String(time.Time(t).UTC().Format(dynamoTimeLayout))}, nil
+}
+
+// UnmarshalDynamo reads the times written before the layout was fixed as
+// well, which RFC 3339 covers
+func (t *dynamoTime) UnmarshalDynamo(av *dynamodb.AttributeValue) error {
+	parsed, err := time.Parse(time.RFC3339Nano, aws.StringValue(av.S))
+	if err != nil {
+		return err
+	}
+	*t = dynamoTime(parsed)
+	return nil
+}
+
+// dynamoAvatar is an avatar as stored in DynamoDB
+type dynamoAvatar struct {
+	Avatar
+	UpdatedAt dynamoTime
+}
+
+func newDynamoAvatar(a Avatar) dynamoAvatar {
+	return dynamoAvatar{Avatar: a, UpdatedAt: dynamoTime(a.UpdatedAt)}
+}
+
+func (d dynamoAvatar) avatar() *Avatar {
+	a := d.Avatar
+	a.UpdatedAt = time.Time(d.UpdatedAt)
+	return &a
+}
+
 func (d *DynamoDB) FindByHash(hash string) (*Avatar, error) {
-	var avatar Avatar
+	var avatar dynamoAvatar
 
 	if err := d.getTable().Get("Hash", hash).One(&avatar); err != nil {
-		return nil, fmt.Errorf("Cannot find avatar with hash %s", hash)
+		if err == dynamo.ErrNotFound {
+			return nil, ErrAvatarNotFound
+		}
+		return nil, err
 	}
 
-	return &avatar, nil
+	return avatar.avatar(), nil
 }
 
+// Save only replaces the avatar if nobody else saved it since it was read,
+// and returns ErrConflict otherwise.
 func (d *DynamoDB) Save(a *Avatar) error {
+	touch(a)
+
+	read := a.Revision
+	a.Revision++
+	put := d.getTable().Put(newDynamoAvatar(*a))
 
-	if err := d.getTable().Put(a).Run(); err != nil {
+	// Avatars saved before revisions were kept have none to compare
+	var err error
+	if read == 0 {
+		err = put.If("attribute_not_exists('Revision')").Run()
+	} else {
+		err = put.If("'Revision' = ?", read).Run()
+	}
+	if err != nil {
+		a.Revision = read
+		if isConditionalCheckFailed(err) {
+			return ErrConflict
+		}
 		return err
 	}
 
 	return nil
 }
 
+func (d *DynamoDB) Delete(hash string) error {
+	return d.getTable().Delete("Hash", hash).Run()
+}
+
+// List pages through a scan of the table, or through the type index when
+// it exists and the avatars are filtered by type. Filters are applied after
+// DynamoDB reads the items, so pages are requested until enough avatars
+// match or the table ends.
+func (d *DynamoDB) List(cursor string, limit int, filter ListFilter) ([]*Avatar, string, error) {
+	if len(filter.Type) > 0 && viper.GetBool("DynamoIndexes") {
+		return d.listByType(cursor, limit, filter)
+	}
+
+	var avatars []*Avatar
+	var start dynamo.PagingKey
+	if len(cursor) > 0 {
+		start = dynamo.PagingKey{
+			"Hash": &dynamodb.AttributeValue{S: aws.String(cursor)},
+		}
+	}
+
+	for {
+		// Reading no more items than are missing, the last one read is the
+		// exact place to continue from
+		scan := d.getTable().Scan().SearchLimit(int64(limit - len(avatars)))
+		if !filter.UpdatedSince.IsZero() {
+			scan = scan.Filter("'UpdatedAt' >= ?", dynamoTime(filter.UpdatedSince))
+		}
+		if len(filter.Type) > 0 {
+			scan = scan.Filter("'Type' = ?", filter.Type)
+		}
+		if len(filter.Tenant) > 0 {
+			scan = scan.Filter("'Tenant' = ?", filter.Tenant)
+		}
+		if start != nil {
+			scan = scan.StartFrom(start)
+		}
+
+		var page []dynamoAvatar
+		last, err := scan.AllWithLastEvaluatedKey(&page)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, avatar := range page {
+			avatars = append(avatars, avatar.avatar())
+		}
+
+		key, ok := last["Hash"]
+		if !ok {
+			return avatars, "", nil
+		}
+		if len(avatars) >= limit {
+			return avatars, aws.StringValue(key.S), nil
+		}
+		start = last
+	}
+}
+
+// listByType queries the type index. It only holds the keys, so the avatars
+// are read from the table as they are found. The cursor is the hash and
+// update time of the last avatar, as both are needed to continue the query.
+func (d *DynamoDB) listByType(cursor string, limit int, filter ListFilter) ([]*Avatar, string, error) {
+	var avatars []*Avatar
+	var start dynamo.PagingKey
+	if len(cursor) > 0 {
+		parts := strings.SplitN(cursor, "@", 2)
+		if len(parts) != 2 {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		start = dynamo.PagingKey{
+			"Hash":      &dynamodb.AttributeValue{S: aws.String(parts[0])},
+			"Type":      &dynamodb.AttributeValue{S: aws.String(filter.Type)},
+			"UpdatedAt": &dynamodb.AttributeValue{S: aws.String(parts[1])},
+		}
+	}
+
+	for {
+		query := d.getTable().Get("Type", filter.Type).Index(dynamoTypeIndex).
+			SearchLimit(int64(limit - len(avatars)))
+		if !filter.UpdatedSince.IsZero() {
+			query = query.Range("UpdatedAt", dynamo.GreaterOrEqual, dynamoTime(filter.UpdatedSince))
+		}
+		if start != nil {
+			query = query.StartFrom(start)
+		}
+
+		var keys []dynamoIndexedAvatarSchema
+		last, err := query.AllWithLastEvaluatedKey(&keys)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, key := range keys {
+			avatar, err := d.FindByHash(key.Hash)
+			if err == ErrAvatarNotFound {
+				continue
+			} else if err != nil {
+				return nil, "", err
+			}
+			// The tenant is not part of the index
+			if filter.Matches(avatar) {
+				avatars = append(avatars, avatar)
+			}
+		}
+
+		hash, ok := last["Hash"]
+		if !ok {
+			return avatars, "", nil
+		}
+		if len(avatars) >= limit {
+			return avatars, aws.StringValue(hash.S) + "@" + aws.StringValue(last["UpdatedAt"].S), nil
+		}
+		start = last
+	}
+}
+
+// dynamoVersion is a previous version, which DynamoDB removes by itself once
+// it expires when DynamoVersionTTL is set
+type dynamoVersion struct {
+	dynamoAvatar
+	ExpiresAt int64 `dynamo:",omitempty"`
+}
+
+func (d *DynamoDB) SaveVersion(a *Avatar) error {
+	version := dynamoVersion{dynamoAvatar: newDynamoAvatar(*a)}
+	if ttl := viper.GetDuration("DynamoVersionTTL"); ttl > 0 {
+		version.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+
+	// Versions never change once archived
+	err := d.getVersionTable().Put(version).If("attribute_not_exists('Version')").Run()
+	if err != nil && !isConditionalCheckFailed(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (d *DynamoDB) FindVersions(hash string) ([]*Avatar, error) {
+	var stored []dynamoAvatar
+
+	err := d.getVersionTable().Get("Hash", hash).Order(dynamo.Descending).All(&stored)
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, err
+	}
+
+	versions := make([]*Avatar, 0, len(stored))
+	for _, version := range stored {
+		versions = append(versions, version.avatar())
+	}
+	return versions, nil
+}
+
+func (d *DynamoDB) DeleteVersion(hash string, version int) error {
+	return d.getVersionTable().Delete("Hash", hash).Range("Version", version).Run()
+}
+
+// dynamoTypeIndex is the global secondary index on the type and update time
+// of the avatars, created when DynamoIndexes is set
+const dynamoTypeIndex = "Type-UpdatedAt-index"
+
+// Schemas of the tables created by Migrate
+type dynamoAvatarSchema struct {
+	Hash string `dynamo:"Hash,hash"`
+}
+
+type dynamoIndexedAvatarSchema struct {
+	Hash      string `dynamo:"Hash,hash"`
+	Type      string `index:"Type-UpdatedAt-index,hash"`
+	UpdatedAt string `index:"Type-UpdatedAt-index,range"`
+}
+
+type dynamoVersionSchema struct {
+	Hash    string `dynamo:"Hash,hash"`
+	Version int    `dynamo:"Version,range"`
+}
+
+type dynamoAPIKeySchema struct {
+	ID string `dynamo:"ID,hash"`
+}
+
+// dynamoToken is a used token ID, expired by DynamoDB along with the token
+type dynamoToken struct {
+	Jti       string `dynamo:"Jti,hash"`
+	ExpiresAt int64
+}
+
+// Migrate creates the tables that do not exist yet, and enables the expiry
+// of versions when DynamoVersionTTL is set. The tables of used tokens and
+// API keys are only created when the JwtReplayStore or ApiKeyStore is db.
 func (d *DynamoDB) Migrate() error {
-	// Nothing to do
+	tables, err := d.db.ListTables().All()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(tables))
+	for _, name := range tables {
+		existing[name] = true
+	}
+
+	var avatarSchema interface{} = dynamoAvatarSchema{}
+	if viper.GetBool("DynamoIndexes") {
+		avatarSchema = dynamoIndexedAvatarSchema{}
+	}
+	if !existing[d.getTable().Name()] {
+		if err := d.createTable(d.getTable(), avatarSchema); err != nil {
+			return err
+		}
+	} else if viper.GetBool("DynamoIndexes") {
+		// Tables created before DynamoIndexes was set have no index yet
+		if err := d.addTypeIndex(d.getTable()); err != nil {
+			return err
+		}
+	}
+	if !existing[d.getVersionTable().Name()] {
+		if err := d.createTable(d.getVersionTable(), dynamoVersionSchema{}); err != nil {
+			return err
+		}
+	}
+
+	if viper.GetDuration("DynamoVersionTTL") > 0 {
+		if err := d.enableTTL(d.getVersionTable()); err != nil {
+			return err
+		}
+	}
+
+	if viper.GetString("JwtReplayStore") == "db" {
+		if !existing[d.getTokenTable().Name()] {
+			if err := d.createTable(d.getTokenTable(), dynamoToken{}); err != nil {
+				return err
+			}
+		}
+		if err := d.enableTTL(d.getTokenTable()); err != nil {
+			return err
+		}
+	}
+
+	if viper.GetString("ApiKeyStore") == "db" && !existing[d.getAPIKeyTable().Name()] {
+		if err := d.createTable(d.getAPIKeyTable(), dynamoAPIKeySchema{}); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// enableTTL expires the items of a table at their ExpiresAt
+func (d *DynamoDB) enableTTL(table dynamo.Table) error {
+	ttl, err := table.DescribeTTL().Run()
+	if err != nil {
+		return err
+	}
+	if ttl.Status == dynamo.TTLEnabled || ttl.Status == dynamo.TTLEnabling {
+		return nil
+	}
+	return table.UpdateTTL("ExpiresAt", true).Run()
+}
+
+// UseToken records a used token ID along with its expiry, see TokenStore.
+// DynamoDB deletes expired items late, so they are overwritten as well.
+func (d *DynamoDB) UseToken(jti string, expires time.Time) (bool, error) {
+	err := d.getTokenTable().Put(dynamoToken{Jti: jti, ExpiresAt: expires.Unix()}).
+		If("attribute_not_exists('Jti') OR 'ExpiresAt' < ?", time.Now().Unix()).
+		Run()
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseToken forgets a used token ID, see TokenStore
+func (d *DynamoDB) ReleaseToken(jti string) error {
+	return d.getTokenTable().Delete("Jti", jti).Run()
+}
+
+// createTable creates a table and waits until it can be used
+func (d *DynamoDB) createTable(table dynamo.Table, schema interface{}) error {
+	read := int64(viper.GetInt("DynamoReadCapacity"))
+	write := int64(viper.GetInt("DynamoWriteCapacity"))
+
+	create := d.db.CreateTable(table.Name(), schema).Provision(read, write)
+	if _, ok := schema.(dynamoIndexedAvatarSchema); ok {
+		create = create.ProvisionIndex(dynamoTypeIndex, read, write).
+			Project(dynamoTypeIndex, dynamo.KeysOnlyProjection)
+	}
+	if err := create.Run(); err != nil {
+		return err
+	}
+
+	for i := 0; i < 60; i++ {
+		desc, err := table.Describe().Run()
+		if err == nil && desc.Status == dynamo.ActiveStatus {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	return fmt.Errorf("table %s did not become active", table.Name())
+}
+
+// addTypeIndex adds the type index to an existing avatar table unless it has
+// it already, and waits until DynamoDB has filled it
+func (d *DynamoDB) addTypeIndex(table dynamo.Table) error {
+	desc, err := table.Describe().Run()
+	if err != nil {
+		return err
+	}
+	if !hasIndex(desc, dynamoTypeIndex) {
+		_, err = table.UpdateTable().CreateIndex(dynamo.Index{
+			Name:           dynamoTypeIndex,
+			HashKey:        "Type",
+			HashKeyType:    dynamo.StringType,
+			RangeKey:       "UpdatedAt",
+			RangeKeyType:   dynamo.StringType,
+			ProjectionType: dynamo.KeysOnlyProjection,
+			Throughput: dynamo.Throughput{
+				Read:  int64(viper.GetInt("DynamoReadCapacity")),
+				Write: int64(viper.GetInt("DynamoWriteCapacity")),
+			},
+		}).Run()
+		if err != nil {
+			return fmt.Errorf("unable to add the index %s to %s: %s", dynamoTypeIndex, table.Name(), err)
+		}
+	}
+
+	// Listing by type queries the index, which fails until it is active
+	for i := 0; i < 60; i++ {
+		desc, err := table.Describe().Run()
+		if err == nil && indexActive(desc, dynamoTypeIndex) {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	return fmt.Errorf("the index %s of %s is still being built, run the migration again once it is active", dynamoTypeIndex, table.Name())
+}
+
+func hasIndex(desc dynamo.Description, name string) bool {
+	for _, index := range desc.GSI {
+		if index.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func indexActive(desc dynamo.Description, name string) bool {
+	for _, index := range desc.GSI {
+		if index.Name == name {
+			return index.Status == dynamo.ActiveStatus
+		}
+	}
+	return false
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
 func (d *DynamoDB) getTable() dynamo.Table {
 	return d.db.Table(viper.GetString("TableName"))
 }
+
+func (d *DynamoDB) getVersionTable() dynamo.Table {
+	return d.db.Table(viper.GetString("VersionTableName"))
+}
+
+func (d *DynamoDB) getTokenTable() dynamo.Table {
+	return d.db.Table(viper.GetString("TokenTableName"))
+}
+
+func (d *DynamoDB) getAPIKeyTable() dynamo.Table {
+	return d.db.Table(viper.GetString("ApiKeyTableName"))
+}
+
+func (d *DynamoDB) FindAPIKey(id string) (*APIKey, error) {
+	var key APIKey
+
+	if err := d.getAPIKeyTable().Get("ID", id).One(&key); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (d *DynamoDB) SaveAPIKey(key *APIKey) error {
+	return d.getAPIKeyTable().Put(key).Run()
+}
+
+func (d *DynamoDB) DeleteAPIKey(id string) error {
+	err := d.getAPIKeyTable().Delete("ID", id).If("attribute_exists('ID')").Run()
+	if isConditionalCheckFailed(err) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+func (d *DynamoDB) ListAPIKeys() ([]*APIKey, error) {
+	var keys []*APIKey
+	if err := d.getAPIKeyTable().Scan().All(&keys); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (d *DynamoDB) TouchAPIKey(id string, at time.Time) error {
+	err := d.getAPIKeyTable().Update("ID", id).Set("LastUsedAt", at).If("attribute_exists('ID')").Run()
+	if isConditionalCheckFailed(err) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package data_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/dolfelt/avatar-go/data/dbtest"
+	"github.com/spf13/viper"
+)
+
+// TestDynamoDB runs against DynamoDB Local at AVATAR_TEST_DYNAMO_ENDPOINT,
+// i.e. http://localhost:8000
+func TestDynamoDB(t *testing.T) {
+	endpoint := os.Getenv("AVATAR_TEST_DYNAMO_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("AVATAR_TEST_DYNAMO_ENDPOINT is not set")
+	}
+
+	viper.Set("DynamoEndpoint", endpoint)
+	viper.Set("DynamoRegion", "us-east-1")
+	viper.Set("DynamoReadCapacity", 5)
+	viper.Set("DynamoWriteCapacity", 5)
+	viper.Set("DynamoIndexes", true)
+	setTestTables()
+
+	db := &data.DynamoDB{}
+	if err := db.Connect(); err != nil {
+		t.Fatal("connect:", err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatal("migrate:", err)
+	}
+
+	dbtest.Run(t, func(t *testing.T) data.DB {
+		return db
+	})
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// readOrientation finds the EXIF orientation of a JPEG image. Images without
+// orientation data are reported as upright (1).
+func readOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+
+	var marker [2]byte
+	if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF || marker[1] != 0xD8 {
+		return 1
+	}
+
+	for {
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// The metadata segments all come before the start of scan
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return 1
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseOrientation(segment[6:])
+		}
+	}
+}
+
+// parseOrientation reads the orientation tag from the first IFD of a TIFF
+// structure.
+func parseOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+
+	return 1
+}
+
+// applyOrientation transforms an image so that it is displayed upright
+// without its EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
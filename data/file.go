@@ -2,6 +2,7 @@ package data
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"image/gif"
 	"image/jpeg"
@@ -10,19 +11,11 @@ import (
 	"log"
 	"net/http"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 )
 
-// FileData describes the file
-type FileData map[string]string
-
 // GetFileExt gets the formatted extension of the supported image file
 func GetFileExt(file io.ReadSeeker) (string, error) {
 	buff := make([]byte, 512) // 512 bytes because --> http://golang.org/pkg/net/http/#DetectContentType
@@ -70,107 +63,214 @@ func GetUploadedFile(c *gin.Context) (io.ReadSeeker, string, error) {
 	return file, ext, nil
 }
 
-// ProcessImageUpload processes uploaded images into the appropriate size
-func ProcessImageUpload(app *Application, avatar Avatar, file io.ReadSeeker) (FileData, error) {
-	files := make(FileData, 0)
+// Encoding quality of the resized avatars and of re-encoded master files
+const (
+	renditionQuality = 80
+	masterQuality    = 95
+)
 
-	if img, _, err := image.Decode(file); err == nil {
-		file.Seek(0, 0)
-		config, _, _ := image.DecodeConfig(file)
-
-		// Find the max square size we can make the avatar
-		maxSize := MinInt(config.Width, config.Height)
-
-		// Loop through all the sizes and create the avatars
-		for size, pixels := range DefaultSizes {
-			if maxSize < pixels && size != "small" {
-				if app.Debug {
-					log.Println("Skipping size:", size)
-				}
-				continue
-			}
-			data := imaging.Thumbnail(img, pixels, pixels, imaging.CatmullRom)
-
-			buf := new(bytes.Buffer)
-			switch avatar.Type {
-			case "jpg":
-				jpeg.Encode(buf, data, &jpeg.Options{Quality: 80})
-				break
-			case "png":
-				png.Encode(buf, data)
-				break
-			case "gif":
-				gif.Encode(buf, data, &gif.Options{NumColors: 256})
-				break
-			}
+// ProcessImageUpload processes uploaded images into the appropriate size, and
+// records the sizes and the details of the image in the avatar. The upload
+// itself is kept as the master file the sizes can be derived from again
+// later. An image that cannot be decoded is reported as an ImageError.
+func ProcessImageUpload(app *Application, avatar *Avatar, file io.ReadSeeker) error {
+	img, format, err := image.Decode(file)
+	if err != nil {
+		return &ImageError{err}
+	}
 
-			if path, errs := uploadImageS3(app, avatar, buf, size); errs == nil {
-				files[size] = path
-			} else if app.Debug {
-				log.Println("Error uploading", size, errs)
-			}
+	// Turn the image upright, as the sizes are stored without EXIF data
+	file.Seek(0, 0)
+	if orientation := readOrientation(file); orientation > 1 {
+		img = applyOrientation(img, orientation)
+
+		buf := new(bytes.Buffer)
+		if err := encodeImage(buf, img, avatar.Type, masterQuality); err != nil {
+			return err
 		}
+		err = uploadMaster(app, *avatar, buf)
 	} else {
-		return nil, err
+		file.Seek(0, 0)
+		err = uploadMaster(app, *avatar, file)
 	}
+	if err != nil {
+		return err
+	}
+	describeSource(avatar, img, format)
 
-	return files, nil
+	avatar.Renditions, err = RenderSizes(app, *avatar, img, FittingSizes(img))
+	if err != nil {
+		app.Storage.Delete(avatar.GetMasterPath())
+		return err
+	}
+	avatar.Sizes = nil
+	for size := range avatar.Renditions {
+		avatar.Sizes = append(avatar.Sizes, size)
+	}
+
+	return nil
 }
 
-func getBucketName() string {
-	return viper.GetString("AWSBucket")
+// FittingSizes lists the sizes an image is large enough to be resized to.
+// The smallest size is always included, upscaling the image if needed.
+func FittingSizes(img image.Image) []string {
+	// Find the max square size we can make the avatar
+	bounds := img.Bounds()
+	maxSize := MinInt(bounds.Dx(), bounds.Dy())
+
+	sizes := make([]string, 0, len(DefaultSizes))
+	for size, pixels := range DefaultSizes {
+		if maxSize < pixels && size != "small" {
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
 }
 
-func getS3() *s3.S3 {
-	awsConfig := &aws.Config{
-		Region: aws.String(viper.GetString("AwsBucketRegion")),
+// RenderSizes resizes the image into the given sizes and uploads them as the
+// files of the avatar. If any size fails, the sizes uploaded so far are
+// removed again and the error is returned, so an avatar is never saved
+// with sizes missing.
+func RenderSizes(app *Application, avatar Avatar, img image.Image, sizes []string) (Renditions, error) {
+	renditions := make(Renditions, len(sizes))
+
+	// Loop through all the sizes and create the avatars
+	for _, size := range sizes {
+		rendition, err := renderSize(app, avatar, img, size)
+		if err != nil {
+			for uploaded := range renditions {
+				app.Storage.Delete(avatar.GetPath(uploaded))
+			}
+			return nil, fmt.Errorf("unable to store the %s size: %s", size, err)
+		}
+		renditions[size] = rendition
 	}
-	if viper.GetString("AwsKey") != "" {
-		awsConfig.Credentials = credentials.NewStaticCredentials(
-			viper.GetString("AwsKey"),
-			viper.GetString("AwsSecret"),
-			"",
-		)
+
+	return renditions, nil
+}
+
+func renderSize(app *Application, avatar Avatar, img image.Image, size string) (Rendition, error) {
+	pixels := DefaultSizes[size]
+	data := imaging.Thumbnail(img, pixels, pixels, imaging.CatmullRom)
+
+	buf := new(bytes.Buffer)
+	if err := encodeImage(buf, data, avatar.Type, renditionQuality); err != nil {
+		return Rendition{}, err
+	}
+
+	rendition := describeRendition(avatar.GetPath(size), data, buf.Bytes())
+	if err := uploadImage(app, avatar, buf, size); err != nil {
+		return Rendition{}, err
 	}
-	return s3.New(session.Must(session.NewSession()), awsConfig)
+	return rendition, nil
 }
 
-func uploadImageS3(app *Application, avatar Avatar, data io.Reader, size string) (string, error) {
-	up := s3manager.NewUploaderWithClient(getS3())
+func encodeImage(w io.Writer, img image.Image, ext string, quality int) error {
+	switch ext {
+	case "jpg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, &gif.Options{NumColors: 256})
+	}
+	return &AppError{"not a supported image file"}
+}
 
-	upParams := &s3manager.UploadInput{
-		Bucket:      aws.String(getBucketName()),
-		Key:         aws.String(avatar.GetPath(size)),
-		Body:        data,
-		ACL:         aws.String("public-read"),
-		ContentType: aws.String("image/" + avatar.Type),
+func uploadImage(app *Application, avatar Avatar, data io.Reader, size string) error {
+	opts := PutOptions{ContentType: avatar.ContentType(), Private: avatar.Private}
+	if avatar.Version > 0 {
+		opts.CacheControl = viper.GetString("ImmutableCacheControl")
 	}
-	result, err := up.Upload(upParams)
-	if err != nil {
-		return "", err
+
+	if err := app.Storage.Put(avatar.GetPath(size), data, opts); err != nil {
+		return err
 	}
 
 	if app.Debug {
-		log.Printf("%#v\n", result)
 		log.Println("Uploaded size ", size, "to", avatar.GetPath(size))
 	}
 
-	return avatar.GetURL(size, viper.GetString("AWSBucket")), nil
+	return nil
 }
 
-// ClearAvatarFiles removes all unneeded files from S3
-func ClearAvatarFiles(avatar Avatar) error {
-	client := getS3()
+// uploadMaster stores the untouched upload privately, so it is never served
+// to clients directly.
+func uploadMaster(app *Application, avatar Avatar, data io.Reader) error {
+	opts := PutOptions{ContentType: avatar.ContentType(), Private: true}
+	if err := app.Storage.Put(avatar.GetMasterPath(), data, opts); err != nil {
+		return err
+	}
 
-	sizes := avatar.Sizes
+	if app.Debug {
+		log.Println("Uploaded master to", avatar.GetMasterPath())
+	}
 
-	for _, size := range sizes {
-		path := avatar.GetPath(size)
-		_, err := client.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(getBucketName()),
-			Key:    aws.String(path),
-		})
-		if err != nil {
+	return nil
+}
+
+// OpenMaster decodes the master file of an avatar.
+func OpenMaster(store Storage, avatar Avatar) (image.Image, error) {
+	img, _, err := decodeFile(store, avatar.GetMasterPath())
+	return img, err
+}
+
+// OpenAvatarFile fetches the stored file for the given size of an avatar. The
+// caller is responsible for closing the returned body.
+func OpenAvatarFile(store Storage, avatar Avatar, size string) (io.ReadCloser, *StoredObject, error) {
+	return store.Get(avatar.GetPath(size))
+}
+
+// CopyAvatarFiles duplicates the files of one avatar version as another.
+func CopyAvatarFiles(store Storage, from Avatar, to Avatar) error {
+	opts := PutOptions{
+		ContentType:  to.ContentType(),
+		CacheControl: viper.GetString("ImmutableCacheControl"),
+		Private:      to.Private,
+	}
+	for _, size := range from.Sizes {
+		if err := store.Copy(from.GetPath(size), to.GetPath(size), opts); err != nil {
+			return err
+		}
+	}
+
+	// Avatars uploaded before masters were kept have none to copy
+	opts = PutOptions{ContentType: to.ContentType(), Private: true}
+	err := store.Copy(from.GetMasterPath(), to.GetMasterPath(), opts)
+	if err != nil && err != ErrObjectNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// MakeAvatarFilesPrivate stores the sizes of an avatar again as private
+// files, so the URLs they could be downloaded from stop working. Each file is
+// copied onto itself, which keeps the keys unchanged.
+func MakeAvatarFilesPrivate(store Storage, avatar Avatar) error {
+	opts := PutOptions{ContentType: avatar.ContentType(), Private: true}
+	if avatar.Version > 0 {
+		opts.CacheControl = viper.GetString("ImmutableCacheControl")
+	}
+	for _, size := range avatar.Sizes {
+		err := store.Copy(avatar.GetPath(size), avatar.GetPath(size), opts)
+		if err != nil && err != ErrObjectNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClearAvatarFiles removes all unneeded files from the storage
+func ClearAvatarFiles(store Storage, avatar Avatar) error {
+	paths := []string{avatar.GetMasterPath()}
+	for _, size := range avatar.Sizes {
+		paths = append(paths, avatar.GetPath(size))
+	}
+
+	for _, path := range paths {
+		if err := store.Delete(path); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,163 @@
+package data
+
+import (
+	"fmt"
+	"image"
+)
+
+// Kinds of problems CheckAvatar can find
+const (
+	ProblemMissing     = "missing"
+	ProblemContentType = "content-type"
+	ProblemDimensions  = "dimensions"
+	ProblemUnreadable  = "unreadable"
+	ProblemNoMaster    = "no-master"
+)
+
+// Problem is an inconsistency between an avatar and its stored files.
+type Problem struct {
+	Size   string `json:"size"`
+	Key    string `json:"key"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// CheckAvatar verifies that every size listed for the avatar exists in the
+// bucket with the expected content type. With dimensions enabled the files
+// are also decoded to check they have the size they are listed as.
+func CheckAvatar(store Storage, avatar Avatar, dimensions bool) ([]Problem, error) {
+	var problems []Problem
+
+	for _, size := range avatar.Sizes {
+		key := avatar.GetPath(size)
+
+		obj, err := store.Stat(key)
+		if err != nil {
+			if err != ErrObjectNotFound {
+				return nil, err
+			}
+			problems = append(problems, Problem{Size: size, Key: key, Kind: ProblemMissing})
+			continue
+		}
+
+		if !avatar.MatchesContentType(obj.ContentType) {
+			problems = append(problems, Problem{
+				Size:   size,
+				Key:    key,
+				Kind:   ProblemContentType,
+				Detail: fmt.Sprintf("stored as %s, expected %s", obj.ContentType, avatar.ContentType()),
+			})
+			continue
+		}
+
+		if dimensions {
+			if problem := checkDimensions(store, avatar, size); problem != nil {
+				problems = append(problems, *problem)
+			}
+		}
+	}
+
+	if _, err := store.Stat(avatar.GetMasterPath()); err != nil {
+		if err != ErrObjectNotFound {
+			return nil, err
+		}
+		problems = append(problems, Problem{Key: avatar.GetMasterPath(), Kind: ProblemNoMaster})
+	}
+
+	return problems, nil
+}
+
+func checkDimensions(store Storage, avatar Avatar, size string) *Problem {
+	body, _, err := OpenAvatarFile(store, avatar, size)
+	if err != nil {
+		return &Problem{Size: size, Key: avatar.GetPath(size), Kind: ProblemUnreadable, Detail: err.Error()}
+	}
+	defer body.Close()
+
+	config, _, err := image.DecodeConfig(body)
+	if err != nil {
+		return &Problem{Size: size, Key: avatar.GetPath(size), Kind: ProblemUnreadable, Detail: err.Error()}
+	}
+
+	pixels, ok := DefaultSizes[size]
+	if !ok || config.Width != pixels || config.Height != pixels {
+		return &Problem{
+			Size:   size,
+			Key:    avatar.GetPath(size),
+			Kind:   ProblemDimensions,
+			Detail: fmt.Sprintf("%dx%d, expected %dx%d", config.Width, config.Height, pixels, pixels),
+		}
+	}
+
+	return nil
+}
+
+// Repairable determines if RepairAvatar can fix any of the problems. A
+// missing master cannot be restored, so it is only reported.
+func Repairable(problems []Problem) bool {
+	for _, problem := range problems {
+		if problem.Kind != ProblemNoMaster {
+			return true
+		}
+	}
+	return false
+}
+
+// RepairAvatar fixes the problems found by CheckAvatar. Sizes with broken
+// files are regenerated as a new version, and sizes with missing files are
+// regenerated in place. Sizes that cannot be regenerated are removed from
+// the avatar, unless that would leave it without any.
+func RepairAvatar(app *Application, avatar Avatar, problems []Problem) (*Avatar, error) {
+	missing := make(map[string]bool)
+	broken := false
+	for _, problem := range problems {
+		switch problem.Kind {
+		case ProblemMissing:
+			missing[problem.Size] = true
+		case ProblemContentType, ProblemDimensions, ProblemUnreadable:
+			broken = true
+		}
+	}
+
+	if broken {
+		result, err := ReprocessAvatar(app, avatar, ReprocessOptions{Force: true})
+		if err != nil {
+			return nil, err
+		}
+		return result.Avatar, nil
+	}
+
+	if len(missing) == 0 {
+		return &avatar, nil
+	}
+
+	pruned := avatar
+	pruned.Sizes = nil
+	pruned.Renditions = avatar.Renditions.copy()
+	for _, size := range avatar.Sizes {
+		if missing[size] {
+			delete(pruned.Renditions, size)
+		} else {
+			pruned.Sizes = append(pruned.Sizes, size)
+		}
+	}
+
+	// Missing sizes are added back if there is anything to derive them from
+	result, err := ReprocessAvatar(app, pruned, ReprocessOptions{})
+	if err == nil && len(result.Sizes) > 0 {
+		return result.Avatar, nil
+	}
+	if err == nil {
+		// It may have been saved with the details of its files
+		pruned = *result.Avatar
+	}
+
+	if len(pruned.Sizes) == 0 {
+		return nil, &AppError{"avatar has no files left to repair it from"}
+	}
+
+	if err := pruned.Save(app.DB); err != nil {
+		return nil, err
+	}
+	return &pruned, nil
+}
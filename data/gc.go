@@ -0,0 +1,195 @@
+package data
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// GCOptions controls a garbage collection run.
+type GCOptions struct {
+	Prefix string        // only collect files below this prefix
+	Grace  time.Duration // skip files younger than this, they may belong to an upload in progress
+	Delete bool          // delete the orphans instead of only reporting them
+	Rate   float64       // maximum database lookups and deletions per second, 0 for no limit
+}
+
+// Orphan is a file in the storage that no avatar references.
+type Orphan struct {
+	StoredObject
+	Hash    string `json:"hash"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// GCReport summarizes a garbage collection run.
+type GCReport struct {
+	Scanned      int      `json:"scanned"`
+	Unrecognized int      `json:"unrecognized"` // files outside of the avatar layout
+	Recent       int      `json:"recent"`       // files within the grace period
+	Orphans      []Orphan `json:"orphans"`
+	OrphanBytes  int64    `json:"orphanBytes"`
+	Deleted      int      `json:"deleted"`
+}
+
+// CollectGarbage finds the files in the storage that neither an avatar nor one
+// of its previous versions references, and deletes them if requested. fn is
+// called with every orphan as soon as it is found.
+func CollectGarbage(app *Application, opts GCOptions, fn func(Orphan)) (*GCReport, error) {
+	report := &GCReport{Orphans: []Orphan{}}
+	cutoff := time.Now().Add(-opts.Grace)
+
+	limit := newThrottle(opts.Rate)
+	defer limit.Stop()
+
+	// Files are listed in key order, which keeps the files of an avatar
+	// together, so only the references of the last avatar are kept around
+	var lastHash string
+	var refs map[string]bool
+	var lookupErr error
+
+	err := app.Storage.List(opts.Prefix, func(obj StoredObject) bool {
+		report.Scanned++
+
+		hash, _, _, ok := ParseObjectKey(obj.Key)
+		if !ok {
+			report.Unrecognized++
+			return true
+		}
+		if obj.LastModified.After(cutoff) {
+			report.Recent++
+			return true
+		}
+
+		if hash != lastHash {
+			limit.Wait()
+			refs, lookupErr = referencedKeys(app, hash)
+			if lookupErr != nil {
+				return false
+			}
+			lastHash = hash
+		}
+		if refs[obj.Key] {
+			return true
+		}
+
+		orphan := Orphan{StoredObject: obj, Hash: hash}
+		if opts.Delete {
+			limit.Wait()
+			if err := app.Storage.Delete(obj.Key); err != nil {
+				orphan.Error = err.Error()
+			} else {
+				orphan.Deleted = true
+				report.Deleted++
+			}
+		}
+
+		report.Orphans = append(report.Orphans, orphan)
+		report.OrphanBytes += obj.Size
+		if fn != nil {
+			fn(orphan)
+		}
+		return true
+	})
+
+	if lookupErr != nil {
+		return report, lookupErr
+	}
+	return report, err
+}
+
+// ParseObjectKey recovers the avatar a file belongs to from its key. Keys
+// that do not follow the layout of GetPath or GetMasterPath are rejected.
+func ParseObjectKey(key string) (hash string, version int, size string, ok bool) {
+	if prefix := viper.GetString("MasterPrefix"); len(prefix) > 0 {
+		key = strings.TrimPrefix(key, prefix)
+	}
+
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return "", 0, "", false
+	}
+
+	name := strings.Split(parts[2], ".")
+	hash = name[0]
+	if len(hash) < 3 || parts[0] != hash[:1] || parts[1] != hash[1:3] {
+		return "", 0, "", false
+	}
+
+	switch len(name) {
+	case 3:
+		// Unversioned files: <hash>.<size>.<ext>
+		return hash, 0, name[1], true
+	case 4:
+		// Versioned files: <hash>.v<version>[-<upload id>].<size>.<ext>
+		if !strings.HasPrefix(name[1], "v") {
+			return "", 0, "", false
+		}
+		version, err := strconv.Atoi(strings.SplitN(name[1][1:], "-", 2)[0])
+		if err != nil || version < 1 {
+			return "", 0, "", false
+		}
+		return hash, version, name[2], true
+	}
+
+	return "", 0, "", false
+}
+
+// referencedKeys collects the keys of all files still in use for a hash.
+func referencedKeys(app *Application, hash string) (map[string]bool, error) {
+	var avatars []*Avatar
+
+	// The default avatar usually has no record of its own
+	if DefaultAvatar != nil && DefaultAvatar.Hash == hash {
+		avatars = append(avatars, DefaultAvatar)
+	}
+
+	current, err := Uncached(app.DB).FindByHash(hash)
+	if err == nil {
+		avatars = append(avatars, current)
+	} else if err != ErrAvatarNotFound {
+		return nil, err
+	}
+
+	versions, err := app.DB.FindVersions(hash)
+	if err != nil {
+		return nil, err
+	}
+	avatars = append(avatars, versions...)
+
+	keys := make(map[string]bool)
+	for _, avatar := range avatars {
+		keys[avatar.GetMasterPath()] = true
+		for _, size := range avatar.Sizes {
+			keys[avatar.GetPath(size)] = true
+		}
+	}
+
+	return keys, nil
+}
+
+// throttle spaces out operations to stay below a rate per second
+type throttle struct {
+	ticker *time.Ticker
+}
+
+func newThrottle(rate float64) *throttle {
+	if rate <= 0 {
+		return &throttle{}
+	}
+	return &throttle{time.NewTicker(time.Duration(float64(time.Second) / rate))}
+}
+
+func (t *throttle) Wait() {
+	if t.ticker != nil {
+		<-t.ticker.C
+	}
+}
+
+func (t *throttle) Stop() {
+	if t.ticker != nil {
+		t.ticker.Stop()
+	}
+}
@@ -0,0 +1,124 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ArchiveVersion keeps a replaced avatar in the version history so that it
+// can be restored later. Versions beyond the configured retention are purged
+// along with their files.
+func ArchiveVersion(app *Application, old Avatar) error {
+	retention := viper.GetInt("VersionRetention")
+	if retention <= 0 {
+		return ClearAvatarFiles(app.Storage, old)
+	}
+
+	if err := app.DB.SaveVersion(&old); err != nil {
+		return err
+	}
+
+	versions, err := app.DB.FindVersions(old.Hash)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions[MinInt(retention, len(versions)):] {
+		if err := app.DB.DeleteVersion(version.Hash, version.Version); err != nil {
+			return err
+		}
+		if err := ClearAvatarFiles(app.Storage, *version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MakeVersionsPrivate makes the files of the previous versions of an avatar
+// private, for when the avatar itself became private. Their records are
+// left as they were archived, as versions never change.
+func MakeVersionsPrivate(app *Application, hash string) error {
+	versions, err := app.DB.FindVersions(hash)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.Private {
+			continue
+		}
+		if err := MakeAvatarFilesPrivate(app.Storage, *version); err != nil {
+			return fmt.Errorf("version %d: %s", version.Version, err)
+		}
+	}
+	return nil
+}
+
+// RestoreVersion publishes a copy of a previous version as the newest version
+// of the avatar. The files are copied rather than reused so the restored
+// avatar gets fresh URLs that caches have not seen before.
+func RestoreVersion(app *Application, hash string, version int) (*Avatar, error) {
+	versions, err := app.DB.FindVersions(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous *Avatar
+	for _, v := range versions {
+		if v.Version == version {
+			previous = v
+			break
+		}
+	}
+	if previous == nil {
+		return nil, &AppError{fmt.Sprintf("version %d of avatar %s does not exist", version, hash)}
+	}
+
+	restored := *previous
+	restored.UpdatedAt = time.Now()
+	restored.UploadID = NewUploadID()
+	restored.Renditions = nil
+
+	current := FindAvatarFresh(app.DB, hash)
+	if current != nil {
+		restored.Version = current.Version + 1
+		restored.Revision = current.Revision
+		restored.CreatedAt = current.CreatedAt
+
+		// Visibility belongs to the avatar, not to the image
+		restored.Private = current.Private
+	} else {
+		restored.Version = versions[0].Version + 1
+		restored.Revision = 0
+	}
+
+	if err := CopyAvatarFiles(app.Storage, *previous, restored); err != nil {
+		ClearAvatarFiles(app.Storage, restored)
+		return nil, err
+	}
+
+	// The copies are identical apart from where they are stored
+	for size, rendition := range previous.Renditions {
+		if restored.Renditions == nil {
+			restored.Renditions = make(Renditions, len(previous.Renditions))
+		}
+		rendition.Key = restored.GetPath(size)
+		restored.Renditions[size] = rendition
+	}
+
+	if err := restored.Save(app.DB); err != nil {
+		ClearAvatarFiles(app.Storage, restored)
+		return nil, err
+	}
+
+	if current != nil {
+		if err := ArchiveVersion(app, *current); err != nil {
+			log.Printf("Error archiving version %d of avatar %s %s", current.Version, hash, err)
+		}
+	}
+
+	return &restored, nil
+}
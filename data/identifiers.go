@@ -0,0 +1,161 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ScopeIdentify lets a token or API key derive the IDs of identifiers
+const ScopeIdentify = "avatar:identify"
+
+// hashLengths are the lengths of the hex encoded hash algorithms avatars
+// can be addressed by. The IDs derived with the IdentifierKey are one of
+// them, so they are only accepted when listed.
+var hashLengths = map[string]int{
+	"md5":     32,
+	"sha1":    40,
+	"sha256":  64,
+	"derived": 64,
+}
+
+// checkHashAlgorithms reports HashAlgorithms that are not supported, and
+// derived IDs that cannot be derived or would be rejected
+func checkHashAlgorithms() error {
+	derived := false
+	for _, algorithm := range viper.GetStringSlice("HashAlgorithms") {
+		algorithm = strings.ToLower(algorithm)
+		if _, ok := hashLengths[algorithm]; !ok {
+			return fmt.Errorf("unknown hash algorithm %q, use md5, sha1, sha256 or derived", algorithm)
+		}
+		derived = derived || algorithm == "derived"
+	}
+
+	hasKey := len(viper.GetString("IdentifierKey")) > 0
+	if derived && !hasKey {
+		return fmt.Errorf("HashAlgorithms lists derived, but no IdentifierKey is configured")
+	}
+	if hasKey && !derived {
+		return fmt.Errorf("an IdentifierKey is configured, add derived to HashAlgorithms to accept the IDs")
+	}
+	return nil
+}
+
+// NormalizeHash lowercases the hash an avatar is requested by, and tells
+// whether it is the hex encoding of one of the HashAlgorithms.
+func NormalizeHash(hash string) (string, bool) {
+	hash = strings.ToLower(hash)
+	if !isHex(hash) {
+		return "", false
+	}
+
+	for _, algorithm := range viper.GetStringSlice("HashAlgorithms") {
+		if hashLengths[strings.ToLower(algorithm)] == len(hash) {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
+func isHex(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeIdentifier trims and lowercases an identifier, so an email
+// address maps to the same ID however it was typed
+func NormalizeIdentifier(identifier string) string {
+	return strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// DeriveID returns the ID of the avatar for an identifier, i.e. an email
+// address. Unlike a plain SHA1, it cannot be computed without the
+// IdentifierKey, so the avatars of known addresses cannot be looked up.
+func DeriveID(identifier string) (string, error) {
+	key := []byte(viper.GetString("IdentifierKey"))
+	if len(key) == 0 {
+		return "", fmt.Errorf("no IdentifierKey is configured")
+	}
+	identifier = NormalizeIdentifier(identifier)
+	if len(identifier) == 0 {
+		return "", fmt.Errorf("the identifier is empty")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(identifier))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// LegacyID returns the hash clients computed for an identifier before IDs
+// were derived by the service
+func LegacyID(identifier string) string {
+	sum := sha1.Sum([]byte(NormalizeIdentifier(identifier)))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrateLegacyAvatar moves the avatar stored under the legacy hash of an
+// identifier to its derived ID, and returns it. Unless keep is set, the
+// legacy avatar is removed along with its previous versions, so it can no
+// longer be found from the address. Nothing is moved, and nil is returned,
+// when there is no legacy avatar or the ID already has one.
+func MigrateLegacyAvatar(app *Application, identifier string, keep bool) (*Avatar, error) {
+	id, err := DeriveID(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := FindAvatarFresh(app.DB, LegacyID(identifier))
+	if legacy == nil {
+		return nil, nil
+	}
+	if FindAvatarFresh(app.DB, id) != nil {
+		// Moved by an earlier run that kept it, or uploaded since
+		if keep {
+			return nil, nil
+		}
+		return nil, DeleteAvatar(app, *legacy)
+	}
+
+	moved := *legacy
+	moved.Hash = id
+	moved.Revision = 0
+	moved.UploadID = NewUploadID()
+
+	// The copies are identical apart from where they are stored
+	moved.Renditions = nil
+	for size, rendition := range legacy.Renditions {
+		if moved.Renditions == nil {
+			moved.Renditions = make(Renditions, len(legacy.Renditions))
+		}
+		rendition.Key = moved.GetPath(size)
+		moved.Renditions[size] = rendition
+	}
+
+	if err := CopyAvatarFiles(app.Storage, *legacy, moved); err != nil {
+		ClearAvatarFiles(app.Storage, moved)
+		return nil, err
+	}
+	if err := moved.Save(app.DB); err != nil {
+		ClearAvatarFiles(app.Storage, moved)
+		return nil, err
+	}
+
+	if !keep {
+		if err := DeleteAvatar(app, *legacy); err != nil {
+			return &moved, fmt.Errorf("avatar moved to %s, but the legacy one remains: %s", id, err)
+		}
+	}
+	return &moved, nil
+}
@@ -0,0 +1,53 @@
+package data_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/spf13/viper"
+)
+
+func TestNormalizeHash(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	id := strings.Repeat("b", 64)
+
+	// Leave the config as the other tests expect it
+	algorithms, key := viper.Get("HashAlgorithms"), viper.Get("IdentifierKey")
+	defer func() {
+		viper.Set("HashAlgorithms", algorithms)
+		viper.Set("IdentifierKey", key)
+	}()
+
+	tests := []struct {
+		name       string
+		algorithms []string
+		key        string
+		hash       string
+		ok         bool
+	}{
+		{"sha1", []string{"sha1"}, "", sha1, true},
+		{"uppercase", []string{"sha1"}, "", strings.ToUpper(sha1), true},
+		{"not hex", []string{"sha1"}, "", sha1[:39] + "g", false},
+		{"too long", []string{"sha1"}, "", id, false},
+		// A key alone does not make 64 hex characters valid
+		{"key without derived", []string{"sha1"}, "secret", id, false},
+		{"derived", []string{"sha1", "derived"}, "secret", id, true},
+		{"sha256", []string{"sha256"}, "", id, true},
+		{"md5", []string{"md5"}, "", sha1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("HashAlgorithms", tt.algorithms)
+			viper.Set("IdentifierKey", tt.key)
+
+			hash, ok := data.NormalizeHash(tt.hash)
+			if ok != tt.ok {
+				t.Errorf("NormalizeHash(%s) with %v = %t, want %t", tt.hash, tt.algorithms, ok, tt.ok)
+			}
+			if ok && hash != strings.ToLower(tt.hash) {
+				t.Errorf("NormalizeHash(%s) = %s, want it lowercased", tt.hash, hash)
+			}
+		})
+	}
+}
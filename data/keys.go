@@ -0,0 +1,357 @@
+package data
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ed25519"
+)
+
+// KeySet holds the keys tokens are verified with. Public keys are selected by
+// the kid header of a token, so several can be active while keys rotate.
+// Tokens signed with HMAC are verified with the shared JwtKey, if set.
+type KeySet struct {
+	secret []byte
+
+	mu     sync.RWMutex
+	static map[string]interface{} // from PEM files, by kid
+	jwks   map[string]interface{} // from the JWKS document, by kid
+
+	jwksSource  string
+	lastRefresh time.Time
+}
+
+// jwksMinRefresh limits how often an unknown kid triggers a JWKS refresh
+const jwksMinRefresh = time.Minute
+
+// LoadKeySet loads the configured verification keys. A JWKS document served
+// over HTTP is refreshed every JwtJwksRefresh, and whenever a token names a
+// key it does not contain yet.
+func LoadKeySet() (*KeySet, error) {
+	k := &KeySet{
+		secret:     []byte(viper.GetString("JwtKey")),
+		static:     make(map[string]interface{}),
+		jwks:       make(map[string]interface{}),
+		jwksSource: viper.GetString("JwtJwks"),
+	}
+
+	for kid, path := range viper.GetStringMapString("JwtPublicKeys") {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePublicKeyPEM(body)
+		if err != nil {
+			return nil, fmt.Errorf("public key %s: %s", kid, err)
+		}
+		k.static[kid] = key
+	}
+
+	if len(k.jwksSource) > 0 {
+		if err := k.Refresh(); err != nil {
+			return nil, err
+		}
+		if interval := viper.GetDuration("JwtJwksRefresh"); isURL(k.jwksSource) && interval > 0 {
+			go k.refreshEvery(interval)
+		}
+	}
+
+	if len(k.secret) == 0 && len(k.static) == 0 && len(k.jwks) == 0 {
+		log.Println("No JwtKey, JwtPublicKeys or JwtJwks are configured, so no token will be accepted.")
+	}
+
+	return k, nil
+}
+
+// Keyfunc returns the key to verify a token with. Keys are only used with
+// the algorithms they belong to, so a public key can never be mistaken for
+// an HMAC secret.
+func (k *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(k.secret) == 0 {
+			return nil, fmt.Errorf("HMAC signed tokens are not accepted")
+		}
+		return k.secret, nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	key, err := k.lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.Method.(type) {
+	case *jwt.SigningMethodRSA:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	case *SigningMethodEdDSA:
+		if _, ok := key.(ed25519.PublicKey); ok {
+			return key, nil
+		}
+	default:
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+
+	return nil, fmt.Errorf("key %q cannot verify %v tokens", kid, t.Header["alg"])
+}
+
+// lookup finds a public key by kid. Tokens without a kid can only be used
+// while there is a single public key.
+func (k *KeySet) lookup(kid string) (interface{}, error) {
+	if key, ok := k.find(kid); ok {
+		return key, nil
+	}
+
+	if len(kid) > 0 && k.refreshDue() {
+		if err := k.Refresh(); err != nil {
+			log.Println("Error refreshing JWKS", err)
+		}
+		if key, ok := k.find(kid); ok {
+			return key, nil
+		}
+	}
+
+	if len(kid) == 0 {
+		return nil, fmt.Errorf("token has no kid to select a key with")
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (k *KeySet) find(kid string) (interface{}, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if len(kid) == 0 {
+		if len(k.static)+len(k.jwks) != 1 {
+			return nil, false
+		}
+		for _, key := range k.static {
+			return key, true
+		}
+		for _, key := range k.jwks {
+			return key, true
+		}
+	}
+
+	if key, ok := k.static[kid]; ok {
+		return key, true
+	}
+	key, ok := k.jwks[kid]
+	return key, ok
+}
+
+func (k *KeySet) refreshDue() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return isURL(k.jwksSource) && time.Since(k.lastRefresh) > jwksMinRefresh
+}
+
+func (k *KeySet) refreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := k.Refresh(); err != nil {
+			log.Println("Error refreshing JWKS", err)
+		}
+	}
+}
+
+// Refresh loads the JWKS document again. The previous keys stay active if it
+// cannot be loaded.
+func (k *KeySet) Refresh() error {
+	k.mu.Lock()
+	k.lastRefresh = time.Now()
+	k.mu.Unlock()
+
+	body, err := readJWKS(k.jwksSource)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.jwks = keys
+	k.mu.Unlock()
+
+	return nil
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+func readJWKS(source string) ([]byte, error) {
+	if !isURL(source) {
+		return ioutil.ReadFile(source)
+	}
+
+	resp, err := jwksClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// jwk is a single key of a JWKS document (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the signature keys of a JWKS document. Keys of unsupported
+// types are skipped, so a document can be shared with other services.
+func parseJWKS(body []byte) (map[string]interface{}, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{}, len(doc.Keys))
+	for _, j := range doc.Keys {
+		if len(j.Use) > 0 && j.Use != "sig" {
+			continue
+		}
+
+		key, err := j.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", j.Kid, err)
+		}
+		if key != nil {
+			keys[j.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+func (j jwk) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", j.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// ed25519PublicKeyPrefix starts the DER encoding of every Ed25519 public key,
+// which x509 cannot parse
+var ed25519PublicKeyPrefix = []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00}
+
+// parsePublicKeyPEM reads an RSA, ECDSA or Ed25519 public key, or the key of
+// a certificate.
+func parsePublicKeyPEM(body []byte) (interface{}, error) {
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "PUBLIC KEY":
+		if len(block.Bytes) == len(ed25519PublicKeyPrefix)+ed25519.PublicKeySize &&
+			bytes.HasPrefix(block.Bytes, ed25519PublicKeyPrefix) {
+			return ed25519.PublicKey(block.Bytes[len(ed25519PublicKeyPrefix):]), nil
+		}
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+}
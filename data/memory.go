@@ -0,0 +1,377 @@
+package data
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDB keeps the avatars in memory. It is meant for tests and local
+// development, and is safe for concurrent use. The zero value is ready to use.
+type MemoryDB struct {
+	mu       sync.RWMutex
+	avatars  map[string]Avatar
+	versions map[string]map[int]Avatar
+	apiKeys  map[string]APIKey
+	tokens   MemoryTokenStore
+}
+
+// Connect does nothing, as there is nothing to connect to
+func (m *MemoryDB) Connect() error {
+	return nil
+}
+
+func (m *MemoryDB) FindByHash(hash string) (*Avatar, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	avatar, ok := m.avatars[hash]
+	if !ok {
+		return nil, ErrAvatarNotFound
+	}
+
+	return copyAvatar(avatar), nil
+}
+
+// Save only replaces the avatar if nobody else saved it since it was read,
+// and returns ErrConflict otherwise.
+func (m *MemoryDB) Save(a *Avatar) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.avatars[a.Hash].Revision != a.Revision {
+		return ErrConflict
+	}
+
+	touch(a)
+	a.Revision++
+
+	if m.avatars == nil {
+		m.avatars = make(map[string]Avatar)
+	}
+	m.avatars[a.Hash] = *copyAvatar(*a)
+
+	return nil
+}
+
+func (m *MemoryDB) Delete(hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.avatars, hash)
+
+	return nil
+}
+
+func (m *MemoryDB) List(cursor string, limit int, filter ListFilter) ([]*Avatar, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hashes := make([]string, 0, len(m.avatars))
+	for hash, avatar := range m.avatars {
+		if hash > cursor && filter.Matches(&avatar) {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+
+	avatars := make([]*Avatar, 0, limit)
+	for _, hash := range hashes[:MinInt(limit, len(hashes))] {
+		avatars = append(avatars, copyAvatar(m.avatars[hash]))
+	}
+
+	next := ""
+	if len(avatars) == limit {
+		next = avatars[len(avatars)-1].Hash
+	}
+
+	return avatars, next, nil
+}
+
+func (m *MemoryDB) SaveVersion(a *Avatar) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.versions == nil {
+		m.versions = make(map[string]map[int]Avatar)
+	}
+	if m.versions[a.Hash] == nil {
+		m.versions[a.Hash] = make(map[int]Avatar)
+	}
+	m.versions[a.Hash][a.Version] = *copyAvatar(*a)
+
+	return nil
+}
+
+func (m *MemoryDB) FindVersions(hash string) ([]*Avatar, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	versions := make([]*Avatar, 0, len(m.versions[hash]))
+	for _, avatar := range m.versions[hash] {
+		versions = append(versions, copyAvatar(avatar))
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	return versions, nil
+}
+
+func (m *MemoryDB) DeleteVersion(hash string, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.versions[hash], version)
+
+	return nil
+}
+
+// UseToken records a used token ID, see TokenStore
+func (m *MemoryDB) UseToken(jti string, expires time.Time) (bool, error) {
+	return m.tokens.UseToken(jti, expires)
+}
+
+// ReleaseToken forgets a used token ID, see TokenStore
+func (m *MemoryDB) ReleaseToken(jti string) error {
+	return m.tokens.ReleaseToken(jti)
+}
+
+func (m *MemoryDB) FindAPIKey(id string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.apiKeys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return copyAPIKey(key), nil
+}
+
+func (m *MemoryDB) SaveAPIKey(key *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.apiKeys == nil {
+		m.apiKeys = make(map[string]APIKey)
+	}
+	m.apiKeys[key.ID] = *copyAPIKey(*key)
+
+	return nil
+}
+
+func (m *MemoryDB) DeleteAPIKey(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.apiKeys[id]; !ok {
+		return ErrAPIKeyNotFound
+	}
+	delete(m.apiKeys, id)
+
+	return nil
+}
+
+func (m *MemoryDB) ListAPIKeys() ([]*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]*APIKey, 0, len(m.apiKeys))
+	for _, key := range m.apiKeys {
+		keys = append(keys, copyAPIKey(key))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+
+	return keys, nil
+}
+
+func (m *MemoryDB) TouchAPIKey(id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.apiKeys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = &at
+	m.apiKeys[id] = key
+
+	return nil
+}
+
+// Migrate does nothing, as there is no schema
+func (m *MemoryDB) Migrate() error {
+	return nil
+}
+
+// copyAPIKey makes sure callers never share the scopes of a stored key
+func copyAPIKey(k APIKey) *APIKey {
+	k.Scopes = append([]string(nil), k.Scopes...)
+	if k.LastUsedAt != nil {
+		at := *k.LastUsedAt
+		k.LastUsedAt = &at
+	}
+	return &k
+}
+
+// copyAvatar makes sure callers never share the sizes of a stored avatar
+func copyAvatar(a Avatar) *Avatar {
+	a.Sizes = append(Sizes(nil), a.Sizes...)
+	a.Renditions = a.Renditions.copy()
+	return &a
+}
+
+// MemoryStorage keeps the avatar files in memory. It is meant for tests and
+// local development, and is safe for concurrent use. The zero value is ready
+// to use.
+type MemoryStorage struct {
+	// BaseURL is prepended to keys to build the URLs of public files. When it
+	// is empty, files have no URL and are served through the service.
+	BaseURL string
+
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data []byte
+	info StoredObject
+	opts PutOptions
+}
+
+// Connect does nothing, as there is nothing to connect to
+func (m *MemoryStorage) Connect() error {
+	return nil
+}
+
+func (m *MemoryStorage) Put(key string, body io.Reader, opts PutOptions) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	contentType := opts.ContentType
+	if len(contentType) == 0 {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.objects == nil {
+		m.objects = make(map[string]memoryObject)
+	}
+	m.objects[key] = memoryObject{
+		data: data,
+		info: StoredObject{
+			Key:          key,
+			Size:         int64(len(data)),
+			LastModified: time.Now(),
+			ContentType:  contentType,
+		},
+		opts: opts,
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) Get(key string) (io.ReadCloser, *StoredObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, nil, ErrObjectNotFound
+	}
+
+	info := obj.info
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), &info, nil
+}
+
+func (m *MemoryStorage) Stat(key string) (*StoredObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+
+	info := obj.info
+	return &info, nil
+}
+
+func (m *MemoryStorage) Copy(from string, to string, opts PutOptions) error {
+	m.mu.RLock()
+	obj, ok := m.objects[from]
+	m.mu.RUnlock()
+
+	if !ok {
+		return ErrObjectNotFound
+	}
+
+	return m.Put(to, bytes.NewReader(obj.data), opts)
+}
+
+func (m *MemoryStorage) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+
+	return nil
+}
+
+func (m *MemoryStorage) List(prefix string, fn func(StoredObject) bool) error {
+	// Collect the matching files first so fn may modify the storage
+	m.mu.RLock()
+	objects := make([]StoredObject, 0, len(m.objects))
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	for _, obj := range objects {
+		if !fn(obj) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) URL(key string) string {
+	if len(m.BaseURL) == 0 {
+		return ""
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Private files must never be handed out
+	if obj, ok := m.objects[key]; ok && obj.opts.Private {
+		return ""
+	}
+	return m.BaseURL + key
+}
+
+// Options returns how a file was stored, for verifying uploads in tests.
+func (m *MemoryStorage) Options(key string) (PutOptions, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	return obj.opts, ok
+}
@@ -0,0 +1,27 @@
+package data_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/dolfelt/avatar-go/data/dbtest"
+)
+
+func TestMemoryDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) data.DB {
+		return &data.MemoryDB{}
+	})
+}
+
+func TestCachedDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) data.DB {
+		// A small cache, so evictions happen during the tests as well
+		return &data.CachedDB{
+			DB:      &data.MemoryDB{},
+			Cache:   &data.MemoryCache{Size: 2},
+			TTL:     time.Minute,
+			MissTTL: time.Minute,
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io/ioutil"
+
+	"github.com/disintegration/imaging"
+)
+
+// Rendition describes the stored file of one size of an avatar
+type Rendition struct {
+	Key      string `json:"key"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Bytes    int64  `json:"bytes"`
+	Checksum string `json:"checksum"` // hex encoded SHA-256 of the file
+}
+
+// Renditions holds the rendition of every stored size
+type Renditions map[string]Rendition
+
+// copy returns a map that can be changed without affecting the original
+func (r Renditions) copy() Renditions {
+	if r == nil {
+		return nil
+	}
+	c := make(Renditions, len(r))
+	for size, rendition := range r {
+		c[size] = rendition
+	}
+	return c
+}
+
+// describeRendition builds the rendition of an encoded file
+func describeRendition(key string, img image.Image, file []byte) Rendition {
+	sum := sha256.Sum256(file)
+	return Rendition{
+		Key:      key,
+		Width:    img.Bounds().Dx(),
+		Height:   img.Bounds().Dy(),
+		Bytes:    int64(len(file)),
+		Checksum: hex.EncodeToString(sum[:]),
+	}
+}
+
+// describeStoredFile builds the rendition of a file that is already stored,
+// for avatars uploaded before renditions were recorded.
+func describeStoredFile(store Storage, key string) (Rendition, error) {
+	body, _, err := store.Get(key)
+	if err != nil {
+		return Rendition{}, err
+	}
+	defer body.Close()
+
+	file, err := ioutil.ReadAll(body)
+	if err != nil {
+		return Rendition{}, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(file))
+	if err != nil {
+		return Rendition{}, err
+	}
+
+	sum := sha256.Sum256(file)
+	return Rendition{
+		Key:      key,
+		Width:    config.Width,
+		Height:   config.Height,
+		Bytes:    int64(len(file)),
+		Checksum: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// dominantColor returns the average color of an image as #rrggbb, to be
+// shown while the avatar loads.
+func dominantColor(img image.Image) string {
+	pixel := imaging.Resize(img, 1, 1, imaging.Box)
+	r, g, b, _ := pixel.At(0, 0).RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// describeSource records the dimensions and color of the image an avatar was
+// derived from.
+func describeSource(avatar *Avatar, img image.Image, format string) {
+	avatar.SourceWidth = img.Bounds().Dx()
+	avatar.SourceHeight = img.Bounds().Dy()
+	avatar.Format = format
+	avatar.Color = dominantColor(img)
+}
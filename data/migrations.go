@@ -0,0 +1,336 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Migrator is implemented by the stores whose schema is versioned. Each
+// migration is applied or rolled back in its own transaction.
+type Migrator interface {
+	MigrationStatus() ([]MigrationStatus, error)
+
+	// MigrateUp applies up to steps pending migrations, or all of them when
+	// steps is 0, and returns how many were applied.
+	MigrateUp(steps int) (int, error)
+
+	// MigrateDown rolls back the last steps applied migrations, and returns
+	// how many were rolled back.
+	MigrateDown(steps int) (int, error)
+}
+
+// MigrationStatus tells whether a migration has been applied
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt"`
+}
+
+// AsMigrator returns the Migrator of a DB, looking through any cache wrapped
+// around it.
+func AsMigrator(db DB) (Migrator, bool) {
+	if cached, ok := db.(*CachedDB); ok {
+		db = cached.DB
+	}
+	m, ok := db.(Migrator)
+	return m, ok
+}
+
+// PendingMigrations counts the migrations that have not been applied yet
+func PendingMigrations(m Migrator) (int, error) {
+	status, err := m.MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	pending := 0
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// Migration is a single versioned change to an SQL schema. {avatars},
+// {versions}, {tokens} and {apikeys} in the statements are replaced by the
+// configured table names.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m Migration) statement(sql string) string {
+	return strings.NewReplacer(
+		"{avatars}", viper.GetString("TableName"),
+		"{versions}", viper.GetString("VersionTableName"),
+		"{tokens}", viper.GetString("TokenTableName"),
+		"{apikeys}", viper.GetString("ApiKeyTableName"),
+	).Replace(sql)
+}
+
+// postgresMigrations is the history of the Postgres schema. Applied
+// migrations must never be changed; add a new one instead. The first ones
+// tolerate the tables created by earlier releases, which used AutoMigrate.
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create avatars",
+		Up: `CREATE TABLE IF NOT EXISTS {avatars} (
+			hash varchar(40) PRIMARY KEY,
+			type char(4) NOT NULL,
+			sizes text NOT NULL,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone
+		)`,
+		Down: `DROP TABLE {avatars}`,
+	},
+	{
+		Version: 2,
+		Name:    "add versions",
+		Up: `ALTER TABLE {avatars} ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 0;
+		CREATE TABLE IF NOT EXISTS {versions} (
+			hash varchar(40) NOT NULL,
+			version integer NOT NULL,
+			type char(4) NOT NULL,
+			sizes text NOT NULL,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			PRIMARY KEY (hash, version)
+		)`,
+		Down: `DROP TABLE {versions};
+		ALTER TABLE {avatars} DROP COLUMN version`,
+	},
+	{
+		Version: 3,
+		Name:    "store sizes as jsonb",
+		Up: `ALTER TABLE {avatars} ALTER COLUMN sizes TYPE jsonb USING sizes::jsonb;
+		ALTER TABLE {versions} ALTER COLUMN sizes TYPE jsonb USING sizes::jsonb`,
+		Down: `ALTER TABLE {avatars} ALTER COLUMN sizes TYPE text USING sizes::text;
+		ALTER TABLE {versions} ALTER COLUMN sizes TYPE text USING sizes::text`,
+	},
+	{
+		Version: 4,
+		Name:    "index updated_at",
+		Up:      `CREATE INDEX IF NOT EXISTS {avatars}_updated_at_idx ON {avatars} (updated_at)`,
+		Down:    `DROP INDEX IF EXISTS {avatars}_updated_at_idx`,
+	},
+	{
+		Version: 5,
+		Name:    "add metadata",
+		Up: `ALTER TABLE {avatars}
+			ADD COLUMN renditions jsonb NOT NULL DEFAULT '{}',
+			ADD COLUMN source_width integer NOT NULL DEFAULT 0,
+			ADD COLUMN source_height integer NOT NULL DEFAULT 0,
+			ADD COLUMN format varchar(8) NOT NULL DEFAULT '',
+			ADD COLUMN uploaded_by text NOT NULL DEFAULT '',
+			ADD COLUMN color varchar(7) NOT NULL DEFAULT '';
+		ALTER TABLE {versions}
+			ADD COLUMN renditions jsonb NOT NULL DEFAULT '{}',
+			ADD COLUMN source_width integer NOT NULL DEFAULT 0,
+			ADD COLUMN source_height integer NOT NULL DEFAULT 0,
+			ADD COLUMN format varchar(8) NOT NULL DEFAULT '',
+			ADD COLUMN uploaded_by text NOT NULL DEFAULT '',
+			ADD COLUMN color varchar(7) NOT NULL DEFAULT ''`,
+		Down: `ALTER TABLE {avatars}
+			DROP COLUMN renditions,
+			DROP COLUMN source_width,
+			DROP COLUMN source_height,
+			DROP COLUMN format,
+			DROP COLUMN uploaded_by,
+			DROP COLUMN color;
+		ALTER TABLE {versions}
+			DROP COLUMN renditions,
+			DROP COLUMN source_width,
+			DROP COLUMN source_height,
+			DROP COLUMN format,
+			DROP COLUMN uploaded_by,
+			DROP COLUMN color`,
+	},
+	{
+		Version: 6,
+		Name:    "add tenant",
+		Up: `ALTER TABLE {avatars} ADD COLUMN tenant text NOT NULL DEFAULT '';
+		ALTER TABLE {versions} ADD COLUMN tenant text NOT NULL DEFAULT '';
+		CREATE INDEX {avatars}_tenant_hash_idx ON {avatars} (tenant, hash)`,
+		Down: `DROP INDEX {avatars}_tenant_hash_idx;
+		ALTER TABLE {versions} DROP COLUMN tenant;
+		ALTER TABLE {avatars} DROP COLUMN tenant`,
+	},
+	{
+		Version: 7,
+		Name:    "add used tokens",
+		Up: `CREATE TABLE {tokens} (
+			jti text PRIMARY KEY,
+			expires_at timestamp with time zone NOT NULL
+		);
+		CREATE INDEX {tokens}_expires_at_idx ON {tokens} (expires_at)`,
+		Down: `DROP TABLE {tokens}`,
+	},
+	{
+		Version: 8,
+		Name:    "add api keys",
+		Up: `CREATE TABLE {apikeys} (
+			id text PRIMARY KEY,
+			name text NOT NULL,
+			hash text NOT NULL,
+			scopes text NOT NULL,
+			tenant text NOT NULL DEFAULT '',
+			created_at timestamp with time zone NOT NULL,
+			last_used_at timestamp with time zone
+		)`,
+		Down: `DROP TABLE {apikeys}`,
+	},
+	{
+		Version: 9,
+		Name:    "add private",
+		Up: `ALTER TABLE {avatars} ADD COLUMN private boolean NOT NULL DEFAULT false;
+		ALTER TABLE {versions} ADD COLUMN private boolean NOT NULL DEFAULT false`,
+		Down: `ALTER TABLE {versions} DROP COLUMN private;
+		ALTER TABLE {avatars} DROP COLUMN private`,
+	},
+	{
+		Version: 10,
+		Name:    "widen hash",
+		Up: `ALTER TABLE {avatars} ALTER COLUMN hash TYPE varchar(64);
+		ALTER TABLE {versions} ALTER COLUMN hash TYPE varchar(64)`,
+		Down: `ALTER TABLE {versions} ALTER COLUMN hash TYPE varchar(40);
+		ALTER TABLE {avatars} ALTER COLUMN hash TYPE varchar(40)`,
+	},
+	{
+		Version: 11,
+		Name:    "add revision and upload id",
+		Up: `ALTER TABLE {avatars}
+			ADD COLUMN revision integer NOT NULL DEFAULT 0,
+			ADD COLUMN upload_id varchar(16) NOT NULL DEFAULT '';
+		ALTER TABLE {versions} ADD COLUMN upload_id varchar(16) NOT NULL DEFAULT ''`,
+		Down: `ALTER TABLE {versions} DROP COLUMN upload_id;
+		ALTER TABLE {avatars} DROP COLUMN revision, DROP COLUMN upload_id`,
+	},
+}
+
+// schemaMigrationsTable records which migrations have been applied
+const schemaMigrationsTable = "schema_migrations"
+
+func (p *PostgresDB) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := p.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(postgresMigrations))
+	for _, m := range postgresMigrations {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+func (p *PostgresDB) MigrateUp(steps int) (int, error) {
+	applied, err := p.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range postgresMigrations {
+		if steps > 0 && count >= steps {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		err := p.runMigration(m.statement(m.Up),
+			"INSERT INTO "+schemaMigrationsTable+" (version, name, applied_at) VALUES (?, ?, ?)",
+			m.Version, m.Name, time.Now())
+		if err != nil {
+			return count, fmt.Errorf("migration %d (%s): %s", m.Version, m.Name, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (p *PostgresDB) MigrateDown(steps int) (int, error) {
+	applied, err := p.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(postgresMigrations) - 1; i >= 0 && count < steps; i-- {
+		m := postgresMigrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err := p.runMigration(m.statement(m.Down),
+			"DELETE FROM "+schemaMigrationsTable+" WHERE version = ?", m.Version)
+		if err != nil {
+			return count, fmt.Errorf("migration %d (%s): %s", m.Version, m.Name, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// runMigration executes the schema change and its bookkeeping together
+func (p *PostgresDB) runMigration(change string, record string, args ...interface{}) error {
+	tx := p.Gorm.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Exec(change).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Exec(record, args...).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// appliedMigrations returns when each applied migration was applied
+func (p *PostgresDB) appliedMigrations() (map[int]time.Time, error) {
+	err := p.Gorm.Exec(`CREATE TABLE IF NOT EXISTS ` + schemaMigrationsTable + ` (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp with time zone NOT NULL
+	)`).Error
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.Gorm.Raw("SELECT version, applied_at FROM " + schemaMigrationsTable).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+
+	return applied, rows.Err()
+}
@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/spf13/viper"
@@ -12,17 +16,81 @@ import (
 // PostgresDB wraps the gorm DB interface
 type PostgresDB struct {
 	Gorm *gorm.DB
+
+	mu           sync.Mutex
+	tokensPruned time.Time
 }
 
 type AvatarPostgres struct {
 	Avatar
-	Sizes string `gorm:"column:sizes;type:text;not null" json:"-"` // list of available sizes
+	Sizes      string `gorm:"column:sizes;type:jsonb;not null" json:"-"`      // list of available sizes
+	Renditions string `gorm:"column:renditions;type:jsonb;not null" json:"-"` // stored file of each size
+	Revision   int    `gorm:"column:revision;not null;default:0" json:"-"`    // incremented on every save
+}
+
+// avatar returns the avatar of a row, with its JSON columns decoded
+func (row *AvatarPostgres) avatar() *Avatar {
+	json.Unmarshal([]byte(row.Sizes), &row.Avatar.Sizes)
+	json.Unmarshal([]byte(row.Renditions), &row.Avatar.Renditions)
+	row.Avatar.Revision = row.Revision
+	return &row.Avatar
 }
 
 func (AvatarPostgres) TableName() string {
 	return viper.GetString("TableName")
 }
 
+// AvatarVersionPostgres stores a previous version of an avatar
+type AvatarVersionPostgres struct {
+	Hash      string `gorm:"type:varchar(64);not null;primary_key"`
+	Version   int    `gorm:"not null;primary_key;auto_increment:false"`
+	Type      string `gorm:"type:char(4);not null"`
+	Sizes     string `gorm:"column:sizes;type:jsonb;not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Renditions   string `gorm:"column:renditions;type:jsonb;not null"`
+	SourceWidth  int    `gorm:"not null;default:0"`
+	SourceHeight int    `gorm:"not null;default:0"`
+	Format       string `gorm:"type:varchar(8);not null"`
+	UploadedBy   string `gorm:"type:text;not null"`
+	Color        string `gorm:"type:varchar(7);not null"`
+	Tenant       string `gorm:"type:text;not null"`
+	Private      bool   `gorm:"not null;default:false"`
+	UploadID     string `gorm:"type:varchar(16);not null"`
+}
+
+func (AvatarVersionPostgres) TableName() string {
+	return viper.GetString("VersionTableName")
+}
+
+// APIKeyPostgres stores an API key, with its scopes separated by spaces
+type APIKeyPostgres struct {
+	ID         string `gorm:"primary_key"`
+	Name       string `gorm:"type:text;not null"`
+	Hash       string `gorm:"type:text;not null"`
+	Scopes     string `gorm:"type:text;not null"`
+	Tenant     string `gorm:"type:text;not null"`
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+func (APIKeyPostgres) TableName() string {
+	return viper.GetString("ApiKeyTableName")
+}
+
+func (row APIKeyPostgres) apiKey() *APIKey {
+	return &APIKey{
+		ID:         row.ID,
+		Name:       row.Name,
+		Hash:       row.Hash,
+		Scopes:     strings.Fields(row.Scopes),
+		Tenant:     row.Tenant,
+		CreatedAt:  row.CreatedAt,
+		LastUsedAt: row.LastUsedAt,
+	}
+}
+
 // Connect begins the connection with the database
 func (p *PostgresDB) Connect() error {
 	connString := fmt.Sprintf(
@@ -46,44 +114,289 @@ func (p *PostgresDB) Connect() error {
 func (p *PostgresDB) FindByHash(hash string) (*Avatar, error) {
 	var avatar AvatarPostgres
 
-	p.Gorm.Find(&avatar, "hash = ?", hash)
-	if len(avatar.Hash) == 0 {
-		return nil, fmt.Errorf("Cannot find avatar with hash %s", hash)
+	res := p.Gorm.Find(&avatar, "hash = ?", hash)
+	if res.RecordNotFound() || (res.Error == nil && len(avatar.Hash) == 0) {
+		return nil, ErrAvatarNotFound
+	}
+	if res.Error != nil {
+		return nil, res.Error
 	}
 
-	// Unmarshal the JSON object into the struct
-	json.Unmarshal([]byte(avatar.Sizes), &avatar.Avatar.Sizes)
-
-	return &avatar.Avatar, nil
+	return avatar.avatar(), nil
 }
 
 func (p *PostgresDB) Save(a *Avatar) error {
+	touch(a)
+
 	// Convert sizes to JSON for storage in the database
 	sizes, err := json.Marshal(a.Sizes)
 	if err != nil {
 		return err
 	}
-	ap := &AvatarPostgres{
-		Avatar: *a,
-		Sizes:  string(sizes),
+	renditions, err := json.Marshal(a.Renditions)
+	if err != nil {
+		return err
+	}
+	columns := map[string]interface{}{
+		"hash":          a.Hash,
+		"type":          a.Type,
+		"sizes":         string(sizes),
+		"version":       a.Version,
+		"revision":      a.Revision + 1,
+		"created_at":    a.CreatedAt,
+		"updated_at":    a.UpdatedAt,
+		"renditions":    string(renditions),
+		"source_width":  a.SourceWidth,
+		"source_height": a.SourceHeight,
+		"format":        a.Format,
+		"uploaded_by":   a.UploadedBy,
+		"color":         a.Color,
+		"tenant":        a.Tenant,
+		"private":       a.Private,
+		"upload_id":     a.UploadID,
 	}
-	res := p.Gorm.Save(ap)
 
+	// Only the save that still has the revision it read gets through, so
+	// concurrent uploads cannot silently replace each other
+	var res *gorm.DB
+	if a.Revision == 0 {
+		query, values := postgresUpsert(viper.GetString("TableName"), columns)
+		res = p.Gorm.Exec(query, values...)
+	} else {
+		delete(columns, "hash")
+		res = p.Gorm.Table(viper.GetString("TableName")).
+			Where("hash = ? AND revision = ?", a.Hash, a.Revision).UpdateColumns(columns)
+	}
 	if res.Error != nil {
 		return res.Error
 	}
-
 	if res.RowsAffected == 0 {
-		res = p.Gorm.Create(ap)
-		if res.Error != nil {
-			return res.Error
-		}
+		return ErrConflict
 	}
 
+	a.Revision++
 	return nil
 }
 
+// postgresUpsert inserts a new avatar, or replaces one that was saved before
+// revisions were kept
+func postgresUpsert(table string, columns map[string]interface{}) (string, []interface{}) {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]interface{}, len(names))
+	placeholders := make([]string, len(names))
+	updates := make([]string, len(names))
+	for i, name := range names {
+		values[i] = columns[name]
+		placeholders[i] = "?"
+		updates[i] = name + " = EXCLUDED." + name
+	}
+
+	query := "INSERT INTO " + table + " AS t (" + strings.Join(names, ", ") + ") " +
+		"VALUES (" + strings.Join(placeholders, ", ") + ") " +
+		"ON CONFLICT (hash) DO UPDATE SET " + strings.Join(updates, ", ") + " WHERE t.revision = 0"
+	return query, values
+}
+
+func (p *PostgresDB) Delete(hash string) error {
+	return p.Gorm.Where("hash = ?", hash).Delete(&AvatarPostgres{}).Error
+}
+
+func (p *PostgresDB) List(cursor string, limit int, filter ListFilter) ([]*Avatar, string, error) {
+	var rows []AvatarPostgres
+
+	query := p.Gorm.Where("hash > ?", cursor)
+	if !filter.UpdatedSince.IsZero() {
+		query = query.Where("updated_at >= ?", filter.UpdatedSince)
+	}
+	if len(filter.Type) > 0 {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if len(filter.Tenant) > 0 {
+		query = query.Where("tenant = ?", filter.Tenant)
+	}
+
+	res := query.Order("hash").Limit(limit).Find(&rows)
+	if res.Error != nil {
+		return nil, "", res.Error
+	}
+
+	avatars := make([]*Avatar, 0, len(rows))
+	for i := range rows {
+		avatars = append(avatars, rows[i].avatar())
+	}
+
+	next := ""
+	if len(avatars) == limit {
+		next = avatars[len(avatars)-1].Hash
+	}
+
+	return avatars, next, nil
+}
+
+func (p *PostgresDB) SaveVersion(a *Avatar) error {
+	sizes, err := json.Marshal(a.Sizes)
+	if err != nil {
+		return err
+	}
+	renditions, err := json.Marshal(a.Renditions)
+	if err != nil {
+		return err
+	}
+	av := &AvatarVersionPostgres{
+		Hash:         a.Hash,
+		Version:      a.Version,
+		Type:         a.Type,
+		Sizes:        string(sizes),
+		CreatedAt:    a.CreatedAt,
+		UpdatedAt:    a.UpdatedAt,
+		Renditions:   string(renditions),
+		SourceWidth:  a.SourceWidth,
+		SourceHeight: a.SourceHeight,
+		Format:       a.Format,
+		UploadedBy:   a.UploadedBy,
+		Color:        a.Color,
+		Tenant:       a.Tenant,
+		Private:      a.Private,
+		UploadID:     a.UploadID,
+	}
+
+	// Versions never change once archived
+	return p.Gorm.Set("gorm:insert_option", "ON CONFLICT (hash, version) DO NOTHING").Create(av).Error
+}
+
+func (p *PostgresDB) FindVersions(hash string) ([]*Avatar, error) {
+	var rows []AvatarVersionPostgres
+
+	res := p.Gorm.Where("hash = ?", hash).Order("version desc").Find(&rows)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	versions := make([]*Avatar, 0, len(rows))
+	for _, row := range rows {
+		avatar := &Avatar{
+			Hash:         row.Hash,
+			Type:         row.Type,
+			Version:      row.Version,
+			CreatedAt:    row.CreatedAt,
+			UpdatedAt:    row.UpdatedAt,
+			SourceWidth:  row.SourceWidth,
+			SourceHeight: row.SourceHeight,
+			Format:       row.Format,
+			UploadedBy:   row.UploadedBy,
+			Color:        row.Color,
+			Tenant:       row.Tenant,
+			Private:      row.Private,
+			UploadID:     row.UploadID,
+		}
+		json.Unmarshal([]byte(row.Sizes), &avatar.Sizes)
+		json.Unmarshal([]byte(row.Renditions), &avatar.Renditions)
+		versions = append(versions, avatar)
+	}
+
+	return versions, nil
+}
+
+func (p *PostgresDB) DeleteVersion(hash string, version int) error {
+	return p.Gorm.Where("hash = ? AND version = ?", hash, version).Delete(&AvatarVersionPostgres{}).Error
+}
+
+// Migrate applies all pending schema migrations
 func (p *PostgresDB) Migrate() error {
-	p.Gorm.AutoMigrate(&AvatarPostgres{})
-	return nil
+	_, err := p.MigrateUp(0)
+	return err
+}
+
+// UseToken records a used token ID along with its expiry, see TokenStore.
+// The ID of an expired token may be recorded again.
+func (p *PostgresDB) UseToken(jti string, expires time.Time) (bool, error) {
+	table := viper.GetString("TokenTableName")
+	now := time.Now()
+
+	if p.pruneTokensDue(now) {
+		if err := p.Gorm.Exec("DELETE FROM "+table+" WHERE expires_at < ?", now).Error; err != nil {
+			return false, err
+		}
+	}
+
+	res := p.Gorm.Exec("INSERT INTO "+table+" AS t (jti, expires_at) VALUES (?, ?) "+
+		"ON CONFLICT (jti) DO UPDATE SET expires_at = EXCLUDED.expires_at WHERE t.expires_at < ?",
+		jti, expires, now)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// ReleaseToken forgets a used token ID, see TokenStore
+func (p *PostgresDB) ReleaseToken(jti string) error {
+	return p.Gorm.Exec("DELETE FROM "+viper.GetString("TokenTableName")+" WHERE jti = ?", jti).Error
+}
+
+func (p *PostgresDB) pruneTokensDue(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now.Sub(p.tokensPruned) < tokenPruneInterval {
+		return false
+	}
+	p.tokensPruned = now
+	return true
+}
+
+func (p *PostgresDB) FindAPIKey(id string) (*APIKey, error) {
+	var row APIKeyPostgres
+
+	res := p.Gorm.Find(&row, "id = ?", id)
+	if res.RecordNotFound() || (res.Error == nil && len(row.ID) == 0) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	return row.apiKey(), nil
+}
+
+func (p *PostgresDB) SaveAPIKey(key *APIKey) error {
+	return p.Gorm.Create(&APIKeyPostgres{
+		ID:         key.ID,
+		Name:       key.Name,
+		Hash:       key.Hash,
+		Scopes:     strings.Join(key.Scopes, " "),
+		Tenant:     key.Tenant,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+	}).Error
+}
+
+func (p *PostgresDB) DeleteAPIKey(id string) error {
+	res := p.Gorm.Where("id = ?", id).Delete(&APIKeyPostgres{})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return res.Error
+}
+
+func (p *PostgresDB) ListAPIKeys() ([]*APIKey, error) {
+	var rows []APIKeyPostgres
+
+	if err := p.Gorm.Order("created_at").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	keys := make([]*APIKey, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, row.apiKey())
+	}
+	return keys, nil
+}
+
+func (p *PostgresDB) TouchAPIKey(id string, at time.Time) error {
+	return p.Gorm.Model(&APIKeyPostgres{}).Where("id = ?", id).UpdateColumn("last_used_at", at).Error
 }
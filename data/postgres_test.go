@@ -0,0 +1,56 @@
+package data_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/dolfelt/avatar-go/data/dbtest"
+	"github.com/spf13/viper"
+)
+
+// TestPostgresDB runs against the server at AVATAR_TEST_DBHOST, with the
+// credentials of the docker-compose setup unless AVATAR_TEST_DBUSER,
+// AVATAR_TEST_DBPASSWORD and AVATAR_TEST_DBDATABASE say otherwise
+func TestPostgresDB(t *testing.T) {
+	host := os.Getenv("AVATAR_TEST_DBHOST")
+	if len(host) == 0 {
+		t.Skip("AVATAR_TEST_DBHOST is not set")
+	}
+
+	viper.Set("DBHost", host)
+	viper.Set("DBPort", envOr("AVATAR_TEST_DBPORT", "5432"))
+	viper.Set("DBUser", envOr("AVATAR_TEST_DBUSER", "docker"))
+	viper.Set("DBPassword", envOr("AVATAR_TEST_DBPASSWORD", "docker"))
+	viper.Set("DBDatabase", envOr("AVATAR_TEST_DBDATABASE", "avatars"))
+	setTestTables()
+
+	db := &data.PostgresDB{}
+	if err := db.Connect(); err != nil {
+		t.Fatal("connect:", err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatal("migrate:", err)
+	}
+
+	dbtest.Run(t, func(t *testing.T) data.DB {
+		return db
+	})
+}
+
+// setTestTables keeps the tests apart from the tables of a running service
+func setTestTables() {
+	viper.Set("TableName", "avatars_test")
+	viper.Set("VersionTableName", "avatars_test_versions")
+	viper.Set("TokenTableName", "avatars_test_tokens")
+	viper.Set("ApiKeyTableName", "avatars_test_api_keys")
+	viper.Set("JwtReplayStore", "db")
+	viper.Set("ApiKeyStore", "db")
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
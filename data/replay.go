@@ -0,0 +1,171 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/spf13/viper"
+)
+
+// ErrTokenUsed is returned when a token ID has been used before
+var ErrTokenUsed = errors.New("token has already been used")
+
+// TokenStore remembers the IDs of used tokens until the tokens expire, so
+// each token is accepted only once. The configured DB is used as the store
+// when it implements this interface.
+type TokenStore interface {
+	// UseToken records a token ID until it expires, and reports false when
+	// it was recorded already. Concurrent calls with one ID succeed once.
+	UseToken(jti string, expires time.Time) (bool, error)
+
+	// ReleaseToken forgets a token ID again, so a token whose request
+	// failed can be retried
+	ReleaseToken(jti string) error
+}
+
+// tokenPruneInterval is how often the stores drop expired token IDs
+const tokenPruneInterval = time.Hour
+
+// LoadTokenStore returns the store selected by JwtReplayStore, or nil when
+// tokens may be reused until they expire.
+func LoadTokenStore(db DB) (TokenStore, error) {
+	switch store := viper.GetString("JwtReplayStore"); store {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return &MemoryTokenStore{}, nil
+	case "db":
+		tokens, ok := AsTokenStore(db)
+		if !ok {
+			return nil, fmt.Errorf("the %s store cannot record used tokens", viper.GetString("Store"))
+		}
+		return tokens, nil
+	case "redis":
+		tokens := &RedisTokenStore{}
+		return tokens, tokens.Connect()
+	default:
+		return nil, fmt.Errorf("unknown JwtReplayStore %q", store)
+	}
+}
+
+// replayChecked reports whether JwtReplayStore makes tokens single use.
+func replayChecked() bool {
+	store := viper.GetString("JwtReplayStore")
+	return len(store) > 0 && store != "none"
+}
+
+// AsTokenStore returns the TokenStore of a DB, looking through any cache
+// wrapped around it.
+func AsTokenStore(db DB) (TokenStore, bool) {
+	if cached, ok := db.(*CachedDB); ok {
+		db = cached.DB
+	}
+	tokens, ok := db.(TokenStore)
+	return tokens, ok
+}
+
+// SpendToken records the jti of a valid token, failing with ErrTokenUsed
+// when it was seen before. Tokens without a jti are let through, unless
+// JwtRequireJti made ParseToken reject them already. The token stays
+// reserved while the request runs, and is given back with RefundToken if
+// the request fails.
+func SpendToken(store TokenStore, claims map[string]interface{}) error {
+	jti, _ := claims["jti"].(string)
+	if len(jti) == 0 {
+		return nil
+	}
+
+	// ParseToken makes sure a token with a jti has an exp
+	exp, _ := claims["exp"].(float64)
+	fresh, err := store.UseToken(jti, time.Unix(int64(exp), 0))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+// RefundToken releases the jti recorded by SpendToken
+func RefundToken(store TokenStore, claims map[string]interface{}) error {
+	jti, _ := claims["jti"].(string)
+	if len(jti) == 0 {
+		return nil
+	}
+	return store.ReleaseToken(jti)
+}
+
+// MemoryTokenStore keeps the used token IDs in memory. Each instance of the
+// service has its own, so it only protects a single instance. The zero
+// value is ready to use.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	used   map[string]time.Time
+	pruned time.Time
+}
+
+func (m *MemoryTokenStore) UseToken(jti string, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.used == nil {
+		m.used = make(map[string]time.Time)
+	}
+	if now.Sub(m.pruned) > tokenPruneInterval {
+		for id, exp := range m.used {
+			if exp.Before(now) {
+				delete(m.used, id)
+			}
+		}
+		m.pruned = now
+	}
+
+	if exp, ok := m.used[jti]; ok && exp.After(now) {
+		return false, nil
+	}
+	m.used[jti] = expires
+
+	return true, nil
+}
+
+func (m *MemoryTokenStore) ReleaseToken(jti string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.used, jti)
+	return nil
+}
+
+// RedisTokenStore keeps the used token IDs in Redis, shared by all instances
+// of the service. Redis expires them along with the tokens.
+type RedisTokenStore struct {
+	client *redis.Client
+}
+
+// Connect opens the connection to the configured Redis server
+func (r *RedisTokenStore) Connect() error {
+	r.client = newRedisClient()
+	return r.client.Ping().Err()
+}
+
+func (r *RedisTokenStore) UseToken(jti string, expires time.Time) (bool, error) {
+	ttl := expires.Sub(time.Now())
+	if ttl <= 0 {
+		// The token is no longer accepted anyway
+		return true, nil
+	}
+	return r.client.SetNX(r.key(jti), 1, ttl).Result()
+}
+
+func (r *RedisTokenStore) ReleaseToken(jti string) error {
+	return r.client.Del(r.key(jti)).Err()
+}
+
+func (r *RedisTokenStore) key(jti string) string {
+	return viper.GetString("RedisPrefix") + "jti:" + jti
+}
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"image"
+	"log"
+	"time"
+)
+
+// ReprocessOptions controls which sizes ReprocessAvatar regenerates.
+type ReprocessOptions struct {
+	Force  bool // regenerate every size, not only the missing ones
+	DryRun bool // only report what would be regenerated
+}
+
+// ReprocessResult describes the outcome of reprocessing a single avatar.
+type ReprocessResult struct {
+	Avatar   *Avatar  `json:"avatar"`
+	Source   string   `json:"source"`   // "master" or the size the files were derived from
+	Sizes    []string `json:"sizes"`    // the sizes that were (or would be) regenerated
+	Metadata bool     `json:"metadata"` // whether missing details of the files were (or would be) recorded
+}
+
+// ReprocessAvatar derives the sizes of an avatar again from its master file,
+// or from its largest size when it was uploaded before masters were kept.
+//
+// Missing sizes are added to the current version. When existing sizes are
+// regenerated they are published as a new version instead, since the files
+// of the current version are cached as immutable. Avatars uploaded before
+// their renditions and source were described get those details recorded.
+func ReprocessAvatar(app *Application, avatar Avatar, opts ReprocessOptions) (*ReprocessResult, error) {
+	img, source, format, err := openSource(app.Storage, avatar)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReprocessResult{Avatar: &avatar, Source: source}
+	for _, size := range FittingSizes(img) {
+		if opts.Force || !avatar.HasSize(size) {
+			result.Sizes = append(result.Sizes, size)
+		}
+	}
+	result.Metadata = !opts.Force && lacksMetadata(avatar, source)
+
+	if (len(result.Sizes) == 0 && !result.Metadata) || opts.DryRun {
+		return result, nil
+	}
+
+	if !opts.Force {
+		next := avatar
+		next.Renditions = avatar.Renditions.copy()
+		if next.Renditions == nil {
+			next.Renditions = make(Renditions)
+		}
+		for _, size := range avatar.Sizes {
+			if _, ok := next.Renditions[size]; ok {
+				continue
+			}
+			// Missing files are left for fsck to report
+			rendition, err := describeStoredFile(app.Storage, avatar.GetPath(size))
+			if err == ErrObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			next.Renditions[size] = rendition
+		}
+		describeReprocessed(&next, img, source, format)
+
+		rendered, err := RenderSizes(app, next, img, result.Sizes)
+		if err != nil {
+			return nil, err
+		}
+		for size, rendition := range rendered {
+			next.Sizes = append(next.Sizes, size)
+			next.Renditions[size] = rendition
+		}
+		next.UpdatedAt = time.Now()
+
+		if err := next.Save(app.DB); err != nil {
+			// The record does not list the sizes just rendered, so their
+			// files would be left behind
+			for _, size := range result.Sizes {
+				app.Storage.Delete(avatar.GetPath(size))
+			}
+			return nil, err
+		}
+		result.Avatar = &next
+		return result, nil
+	}
+
+	next := avatar
+	next.Version = avatar.Version + 1
+	next.UploadID = NewUploadID()
+	next.Sizes = nil
+	next.UpdatedAt = time.Now()
+
+	// Carry the master over to the new version
+	master := avatar
+	master.Sizes = nil
+	if err := CopyAvatarFiles(app.Storage, master, next); err != nil {
+		return nil, err
+	}
+
+	describeReprocessed(&next, img, source, format)
+	// The old files are cleared once the new version is saved, so it must
+	// not go without any of the sizes
+	next.Renditions, err = RenderSizes(app, next, img, result.Sizes)
+	if err != nil {
+		ClearAvatarFiles(app.Storage, next)
+		return nil, err
+	}
+	for size := range next.Renditions {
+		next.Sizes = append(next.Sizes, size)
+	}
+
+	if err := next.Save(app.DB); err != nil {
+		ClearAvatarFiles(app.Storage, next)
+		return nil, err
+	}
+
+	// The old files show the same image, so they are not worth archiving
+	if err := ClearAvatarFiles(app.Storage, avatar); err != nil {
+		log.Printf("Error clearing version %d of avatar %s %s", avatar.Version, avatar.Hash, err)
+	}
+
+	result.Avatar = &next
+	return result, nil
+}
+
+// lacksMetadata determines if details of the avatar are missing that
+// reprocessing it could record.
+func lacksMetadata(avatar Avatar, source string) bool {
+	for _, size := range avatar.Sizes {
+		if _, ok := avatar.Renditions[size]; !ok {
+			return true
+		}
+	}
+	if source == "master" && avatar.SourceWidth == 0 {
+		return true
+	}
+	return len(avatar.Color) == 0
+}
+
+// describeReprocessed records the details of the image the sizes were
+// derived from. Only the master has the dimensions of the upload.
+func describeReprocessed(avatar *Avatar, img image.Image, source string, format string) {
+	if source == "master" {
+		describeSource(avatar, img, format)
+	} else if len(avatar.Color) == 0 {
+		avatar.Color = dominantColor(img)
+	}
+}
+
+// openSource decodes the best available image to derive the sizes from, and
+// returns where it came from along with its format.
+func openSource(store Storage, avatar Avatar) (image.Image, string, string, error) {
+	img, format, err := decodeFile(store, avatar.GetMasterPath())
+	if err == nil {
+		return img, "master", format, nil
+	}
+	if err != ErrObjectNotFound {
+		return nil, "", "", err
+	}
+
+	size := avatar.LargestSize()
+	if len(size) == 0 {
+		return nil, "", "", &AppError{"avatar has no master or sizes to reprocess"}
+	}
+
+	img, format, err = decodeFile(store, avatar.GetPath(size))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return img, size, format, nil
+}
+
+func decodeFile(store Storage, key string) (image.Image, string, error) {
+	body, _, err := store.Get(key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+
+	return image.Decode(body)
+}
@@ -0,0 +1,162 @@
+package data
+
+import (
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/viper"
+)
+
+// S3Storage stores the avatar files in an S3 bucket
+type S3Storage struct {
+	client *s3.S3
+	bucket string
+}
+
+// Connect creates the client for the configured bucket
+func (s *S3Storage) Connect() error {
+	awsConfig := &aws.Config{
+		Region: aws.String(viper.GetString("AwsBucketRegion")),
+	}
+	if viper.GetString("AwsKey") != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			viper.GetString("AwsKey"),
+			viper.GetString("AwsSecret"),
+			"",
+		)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+
+	s.client = s3.New(sess, awsConfig)
+	s.bucket = viper.GetString("AWSBucket")
+
+	return nil
+}
+
+func (s *S3Storage) Put(key string, body io.Reader, opts PutOptions) error {
+	up := s3manager.NewUploaderWithClient(s.client)
+
+	params := &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ACL:         aws.String(s3ACL(opts)),
+		ContentType: aws.String(opts.ContentType),
+	}
+	if len(opts.CacheControl) > 0 {
+		params.CacheControl = aws.String(opts.CacheControl)
+	}
+
+	_, err := up.Upload(params)
+	return err
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, *StoredObject, error) {
+	result, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+
+	return result.Body, &StoredObject{
+		Key:          key,
+		Size:         aws.Int64Value(result.ContentLength),
+		LastModified: aws.TimeValue(result.LastModified),
+		ContentType:  aws.StringValue(result.ContentType),
+	}, nil
+}
+
+func (s *S3Storage) Stat(key string) (*StoredObject, error) {
+	result, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return &StoredObject{
+		Key:          key,
+		Size:         aws.Int64Value(result.ContentLength),
+		LastModified: aws.TimeValue(result.LastModified),
+		ContentType:  aws.StringValue(result.ContentType),
+	}, nil
+}
+
+func (s *S3Storage) Copy(from string, to string, opts PutOptions) error {
+	params := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(to),
+		CopySource:        aws.String(s.bucket + "/" + from),
+		ACL:               aws.String(s3ACL(opts)),
+		ContentType:       aws.String(opts.ContentType),
+		MetadataDirective: aws.String("REPLACE"),
+	}
+	if len(opts.CacheControl) > 0 {
+		params.CacheControl = aws.String(opts.CacheControl)
+	}
+
+	_, err := s.client.CopyObject(params)
+	return s3Error(err)
+}
+
+func (s *S3Storage) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Storage) List(prefix string, fn func(StoredObject) bool) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	return s.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			next := fn(StoredObject{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+			if !next {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (s *S3Storage) URL(key string) string {
+	return "//s3.amazonaws.com/" + s.bucket + "/" + key
+}
+
+func s3ACL(opts PutOptions) string {
+	if opts.Private {
+		return "private"
+	}
+	return "public-read"
+}
+
+// s3Error translates missing keys into ErrObjectNotFound
+func s3Error(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound" {
+			return ErrObjectNotFound
+		}
+	}
+	return err
+}
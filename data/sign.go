@@ -0,0 +1,104 @@
+package data
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ed25519"
+)
+
+// SigningKey signs tokens the service accepts, for tools and tests that
+// need to mint them
+type SigningKey struct {
+	Method jwt.SigningMethod
+	Key    interface{}
+	Kid    string
+}
+
+// LoadSigningKey reads the private key at path, or uses the shared JwtKey
+// for HMAC when path is empty. The algorithm follows from the type of key.
+func LoadSigningKey(path string, kid string) (*SigningKey, error) {
+	if len(path) == 0 {
+		secret := viper.GetString("JwtKey")
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("no JwtKey or private key is configured")
+		}
+		return &SigningKey{Method: jwt.SigningMethodHS256, Key: []byte(secret)}, nil
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyPEM(body)
+	if err != nil {
+		return nil, fmt.Errorf("private key %s: %s", path, err)
+	}
+
+	s := &SigningKey{Key: key, Kid: kid}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.Method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			s.Method = jwt.SigningMethodES256
+		case 384:
+			s.Method = jwt.SigningMethodES384
+		case 521:
+			s.Method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		s.Method = SigningMethodEd25519
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return s, nil
+}
+
+// Sign creates a token with the claims, naming the key in the kid header
+func (s *SigningKey) Sign(claims map[string]interface{}) (string, error) {
+	token := jwt.New(s.Method)
+	token.Claims = claims
+	if len(s.Kid) > 0 {
+		token.Header["kid"] = s.Kid
+	}
+	return token.SignedString(s.Key)
+}
+
+// ed25519PrivateKeyPrefix starts the PKCS #8 encoding of every Ed25519
+// private key, followed by its seed
+var ed25519PrivateKeyPrefix = []byte{0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x04, 0x22, 0x04, 0x20}
+
+// parsePrivateKeyPEM reads an RSA, ECDSA or Ed25519 private key
+func parsePrivateKeyPEM(body []byte) (interface{}, error) {
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		if len(block.Bytes) == len(ed25519PrivateKeyPrefix)+ed25519.SeedSize &&
+			bytes.HasPrefix(block.Bytes, ed25519PrivateKeyPrefix) {
+			return ed25519.NewKeyFromSeed(block.Bytes[len(ed25519PrivateKeyPrefix):]), nil
+		}
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+}
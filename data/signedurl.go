@@ -0,0 +1,66 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Query parameters of a signed URL
+const (
+	SignedURLExpires   = "expires"
+	SignedURLSignature = "signature"
+)
+
+// SignAvatarURL returns the path of an avatar with a signature that lets
+// it be read until expires, even when it is private. The signature covers
+// the hash only, so the size may be changed.
+func SignAvatarURL(hash string, size string, expires time.Time) (string, error) {
+	key := signedURLKey()
+	if len(key) == 0 {
+		return "", fmt.Errorf("no SignedURLKey is configured")
+	}
+
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set(SignedURLExpires, exp)
+	query.Set(SignedURLSignature, avatarSignature(key, hash, exp))
+
+	path := "/" + hash
+	if len(size) > 0 {
+		path += "/" + size
+	}
+	return path + "?" + query.Encode(), nil
+}
+
+// VerifyAvatarSignature checks the expiry and signature of a URL for the
+// avatar. Nothing verifies without a SignedURLKey.
+func VerifyAvatarSignature(hash string, expires string, signature string) bool {
+	key := signedURLKey()
+	if len(key) == 0 || len(expires) == 0 || len(signature) == 0 {
+		return false
+	}
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+
+	return hmac.Equal([]byte(avatarSignature(key, hash, expires)), []byte(signature))
+}
+
+func avatarSignature(key []byte, hash string, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hash + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedURLKey() []byte {
+	return []byte(viper.GetString("SignedURLKey"))
+}
@@ -0,0 +1,42 @@
+package data
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrObjectNotFound is returned by a Storage when no file exists for a key
+var ErrObjectNotFound = errors.New("file not found")
+
+// Storage holds the avatar files
+type Storage interface {
+	Connect() error
+	Put(key string, body io.Reader, opts PutOptions) error
+	Get(key string) (io.ReadCloser, *StoredObject, error)
+	Stat(key string) (*StoredObject, error)
+	Copy(from string, to string, opts PutOptions) error
+	Delete(key string) error
+
+	// List calls fn for every file below the prefix, until fn returns false.
+	List(prefix string, fn func(StoredObject) bool) error
+
+	// URL returns the address clients can download a file from directly, or
+	// an empty string when files have to be served through the service.
+	URL(key string) string
+}
+
+// PutOptions describes how a file is stored
+type PutOptions struct {
+	ContentType  string
+	CacheControl string
+	Private      bool
+}
+
+// StoredObject describes a file in the storage
+type StoredObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	ContentType  string    `json:"contentType,omitempty"`
+}
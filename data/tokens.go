@@ -0,0 +1,178 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+// Scopes a token can grant in its scope claim
+const (
+	ScopeWrite  = "avatar:write"
+	ScopeDelete = "avatar:delete"
+	ScopeAdmin  = "avatar:admin"
+)
+
+// legacyScopes are granted to tokens without a scope claim when
+// JwtLegacyTokens is set, matching what such tokens could do before scopes
+var legacyScopes = []string{ScopeWrite, ScopeDelete}
+
+// ParseToken verifies the signature of a token along with its standard
+// claims. The library checks exp and nbf; the issuer and audience are
+// checked against JwtIssuers and JwtAudience when those are configured, and
+// an exp or jti is required when JwtRequireExp or JwtRequireJti is set.
+func (k *KeySet) ParseToken(raw string) (*jwt.Token, error) {
+	token, err := jwt.Parse(raw, k.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("token was invalid for unknown reason")
+	}
+
+	if err := validateClaims(token.Claims); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func validateClaims(claims map[string]interface{}) error {
+	jti, _ := claims["jti"].(string)
+	if _, ok := claims["exp"].(float64); !ok {
+		if viper.GetBool("JwtRequireExp") {
+			return fmt.Errorf("token has no exp")
+		}
+		// A used jti is only remembered until the token expires
+		if len(jti) > 0 && replayChecked() {
+			return fmt.Errorf("single use token has no exp")
+		}
+	}
+
+	if viper.GetBool("JwtRequireJti") {
+		if len(jti) == 0 {
+			return fmt.Errorf("token has no jti")
+		}
+	}
+
+	if issuers := viper.GetStringSlice("JwtIssuers"); len(issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !containsString(issuers, iss) {
+			return fmt.Errorf("issuer %q is not trusted", iss)
+		}
+	}
+
+	if audience := viper.GetString("JwtAudience"); len(audience) > 0 {
+		if !containsString(claimStrings(claims["aud"]), audience) {
+			return fmt.Errorf("token is not meant for audience %q", audience)
+		}
+	}
+
+	return nil
+}
+
+// TokenScopes lists the scopes a token grants. The scope claim may be a
+// space separated string or a list.
+func TokenScopes(claims map[string]interface{}) []string {
+	scope, ok := claims["scope"]
+	if !ok {
+		if viper.GetBool("JwtLegacyTokens") {
+			return legacyScopes
+		}
+		return nil
+	}
+
+	if s, ok := scope.(string); ok {
+		return strings.Fields(s)
+	}
+	return claimStrings(scope)
+}
+
+// CheckScope reports an error unless the token grants the scope
+func CheckScope(claims map[string]interface{}, scope string) error {
+	if !containsString(TokenScopes(claims), scope) {
+		return fmt.Errorf("token does not grant %s", scope)
+	}
+	return nil
+}
+
+// Grants of a token, from the most to the least specific
+const (
+	GrantHash   = "hash"   // the hash claim names the avatar
+	GrantHashes = "hashes" // the hashes claim lists the avatar
+	GrantTenant = "tenant" // the avatar exists and belongs to the tenant claim
+	GrantAdmin  = "admin"  // the admin claim is true, granting every avatar
+)
+
+// AuthorizeHash determines which grant of a token allows acting on an
+// avatar. The avatar is only looked up for tenant grants.
+func AuthorizeHash(db DB, claims map[string]interface{}, hash string) (string, error) {
+	// Requests are lowercased, but tokens may name the hash in any case
+	if h, ok := claims["hash"].(string); ok && strings.EqualFold(h, hash) {
+		return GrantHash, nil
+	}
+	for _, h := range claimStrings(claims["hashes"]) {
+		if strings.EqualFold(h, hash) {
+			return GrantHashes, nil
+		}
+	}
+
+	// A hash nobody uploaded yet belongs to no tenant, so new avatars need
+	// a grant naming them
+	var lookupErr error
+	if tenant, ok := claims["tenant"].(string); ok && len(tenant) > 0 {
+		avatar, err := db.FindByHash(hash)
+		if err == nil && avatar.Tenant == tenant {
+			return GrantTenant, nil
+		}
+		if err != nil && err != ErrAvatarNotFound {
+			lookupErr = err
+		}
+	}
+
+	if grant, err := AuthorizeAll(claims); err == nil {
+		return grant, nil
+	}
+
+	if lookupErr != nil {
+		return "", lookupErr
+	}
+	return "", fmt.Errorf("token does not grant access to %s", hash)
+}
+
+// AuthorizeAll checks that a token grants every avatar, as needed for
+// requests that are not about a single one.
+func AuthorizeAll(claims map[string]interface{}) (string, error) {
+	if admin, _ := claims["admin"].(bool); admin {
+		return GrantAdmin, nil
+	}
+	return "", fmt.Errorf("token does not grant access to all avatars")
+}
+
+// claimStrings reads a claim that may hold a single string or a list
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+// adminPrefix is the path under which all management endpoints live
+const adminPrefix = "/admin"
+
+// registerAdmin creates the router for the management endpoints. These live
+// in their own router because every path on the main router is captured by
+// the :hash parameter.
+func registerAdmin(app *data.Application) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(validHash())
+
+	// Counters only, so monitoring can scrape them without a token
+	router.GET(adminPrefix+"/metrics", metrics())
+
+	// Services deriving IDs only need the identify scope, not the admin one
+	router.POST(adminPrefix+"/ids", authenticate(app, APIKeyOrTokenRequired(app, data.ScopeIdentify)), deriveID(app))
+
+	admin := router.Group(adminPrefix)
+	admin.Use(authenticate(app, AuthRequired(app, data.ScopeAdmin)))
+
+	admin.GET("/avatars", listAvatars(app))
+	admin.GET("/apikeys", listAPIKeys(app))
+
+	admin.GET("/avatars/:hash/versions", listVersions(app))
+	admin.POST("/avatars/:hash/versions/:version/restore", restoreVersion(app))
+	admin.POST("/avatars/:hash/reprocess", reprocess(app))
+	admin.GET("/avatars/:hash/url", signURL(app))
+
+	return router
+}
+
+// mount hands every request below prefix over to the given router.
+func mount(prefix string, router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.HasPrefix(c.Request.URL.Path, prefix+"/") {
+			c.Next()
+			return
+		}
+
+		router.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+// listAPIKeys shows every key without its hash. Only this endpoint knows
+// when the keys from the config were last used.
+func listAPIKeys(app *data.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app.APIKeys == nil {
+			c.JSON(200, gin.H{"data": []*data.APIKey{}, "error": nil})
+			return
+		}
+
+		keys, err := app.APIKeys.List()
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{"data": keys, "error": nil})
+	}
+}
@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// setCacheHeaders adds the validators and caching policy for an avatar
+// response that may be stored for up to maxAge seconds.
+func setCacheHeaders(c *gin.Context, avatar *data.Avatar, maxAge int) {
+	c.Header("ETag", avatar.ETag())
+	if !avatar.UpdatedAt.IsZero() {
+		c.Header("Last-Modified", avatar.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	directives := viper.GetString("CacheControl")
+	if maxAge > 0 {
+		if len(directives) > 0 {
+			directives += ", "
+		}
+		directives += fmt.Sprintf("max-age=%d", maxAge)
+	}
+	if len(directives) > 0 {
+		c.Header("Cache-Control", directives)
+	}
+}
+
+// setPrivateCacheControl keeps a private avatar out of shared caches, and
+// from being reused once its signed URL has expired
+func setPrivateCacheControl(c *gin.Context) {
+	maxAge := viper.GetInt("ProxyMaxAge")
+	if expires, err := strconv.ParseInt(c.Query(data.SignedURLExpires), 10, 64); err == nil {
+		maxAge = data.MinInt(maxAge, int(expires-time.Now().Unix()))
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+}
+
+// notModified checks the conditional request headers against the avatar.
+// If-None-Match takes precedence over If-Modified-Since, as per RFC 7232.
+func notModified(c *gin.Context, avatar *data.Avatar) bool {
+	if match := c.Request.Header.Get("If-None-Match"); len(match) > 0 {
+		etag := avatar.ETag()
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(c.Request.Header.Get("If-Modified-Since"))
+	if err != nil || avatar.UpdatedAt.IsZero() {
+		return false
+	}
+
+	// HTTP dates only carry second precision
+	return !avatar.UpdatedAt.Truncate(time.Second).After(since)
+}
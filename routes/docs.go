@@ -30,14 +30,60 @@ func index() gin.HandlerFunc {
 					"href":   "/:hash",
 					"method": "DELETE",
 				},
+				"avatar.list": gin.H{
+					"type":     "endpoint",
+					"href":     "/admin/avatars",
+					"method":   "GET",
+					"optional": []string{"cursor", "limit", "updatedSince", "type", "tenant"},
+				},
+				"avatar.versions": gin.H{
+					"type":   "endpoint",
+					"href":   "/admin/avatars/:hash/versions",
+					"method": "GET",
+				},
+				"avatar.restore": gin.H{
+					"type":   "endpoint",
+					"href":   "/admin/avatars/:hash/versions/:version/restore",
+					"method": "POST",
+				},
+				"avatar.reprocess": gin.H{
+					"type":   "endpoint",
+					"href":   "/admin/avatars/:hash/reprocess",
+					"method": "POST",
+				},
+				"avatar.url": gin.H{
+					"type":     "endpoint",
+					"href":     "/admin/avatars/:hash/url",
+					"method":   "GET",
+					"optional": []string{"ttl", "size"},
+				},
+				"ids": gin.H{
+					"type":     "endpoint",
+					"href":     "/admin/ids",
+					"method":   "POST",
+					"required": []string{"identifier"},
+				},
+				"apikeys": gin.H{
+					"type":   "endpoint",
+					"href":   "/admin/apikeys",
+					"method": "GET",
+				},
+				"metrics": gin.H{
+					"type":   "endpoint",
+					"href":   "/admin/metrics",
+					"method": "GET",
+				},
 			},
 			"meta": gin.H{
 				"parameters": gin.H{
 					":hash": gin.H{
-						"desc": "sha1 hash of the prefixed user id",
+						"desc": "lowercase hex of the sha1 (or another of the HashAlgorithms) of the prefixed user id, or the ID derived from it by /admin/ids",
 					},
 					":backup": gin.H{
-						"desc": "another sha1 hash to use if the given :hash does not exist",
+						"desc": "another hash to use if the given :hash does not exist",
+					},
+					":version": gin.H{
+						"desc": "version number of a previous avatar",
 					},
 					":size": gin.H{
 						"desc":    "one of the possible sizes",
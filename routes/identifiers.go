@@ -0,0 +1,28 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+// deriveID tells a trusted service the ID to store and serve the avatar of
+// an identifier under, computed with the IdentifierKey
+func deriveID(app *data.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identifier := data.NormalizeIdentifier(c.PostForm("identifier"))
+		if len(identifier) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "identifier is required"})
+			return
+		}
+
+		id, err := data.DeriveID(identifier)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{"data": gin.H{"id": id}, "error": nil})
+	}
+}
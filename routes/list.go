@@ -0,0 +1,48 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+// maxListLimit caps how many avatars are returned in a single page
+const maxListLimit = 1000
+
+func listAvatars(app *data.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		limit = data.MinInt(limit, maxListLimit)
+
+		filter := data.ListFilter{
+			Type:   c.Query("type"),
+			Tenant: c.Query("tenant"),
+		}
+		if since := c.Query("updatedSince"); len(since) > 0 {
+			filter.UpdatedSince, err = time.Parse(time.RFC3339, since)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "updatedSince must be an RFC 3339 timestamp"})
+				return
+			}
+		}
+
+		avatars, next, err := app.DB.List(c.Query("cursor"), limit, filter)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"data":   avatars,
+			"cursor": next,
+			"error":  nil,
+		})
+	}
+}
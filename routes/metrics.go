@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+func metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"data": gin.H{
+				"cache": data.CacheStats(),
+			},
+			"error": nil,
+		})
+	}
+}
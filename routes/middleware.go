@@ -2,11 +2,14 @@ package routes
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
 
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/dolfelt/avatar-go/data"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 )
 
 func getCORSConfig() cors.Config {
@@ -17,9 +20,63 @@ func getCORSConfig() cors.Config {
 	return corsConfig
 }
 
+// validHash rejects requests for hashes that are not the hex of one of the
+// HashAlgorithms, and lowercases the others so every later handler and the
+// token checks see the form avatars are stored under
+func validHash() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for i, param := range c.Params {
+			if param.Key != "hash" {
+				continue
+			}
+			hash, ok := data.NormalizeHash(param.Value)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid hash"})
+				c.Abort()
+				return
+			}
+			c.Params[i].Value = hash
+		}
+		c.Next()
+	}
+}
+
+// authenticate puts the check of a route in front of it as the AuthPolicy of
+// the app demands
+func authenticate(app *data.Application, required gin.HandlerFunc) gin.HandlerFunc {
+	switch app.AuthPolicy {
+	case data.AuthPolicyDisabled:
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	case data.AuthPolicyDisabledForLoopback:
+		return func(c *gin.Context) {
+			// The peer address, as forwarded headers can be made up
+			if isLoopback(c.Request.RemoteAddr) {
+				c.Next()
+				return
+			}
+			required(c)
+		}
+	}
+
+	return required
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // AuthRequired detects if a JWT token has been sent with the request and
-// validates the token before completing the request.
-func AuthRequired() gin.HandlerFunc {
+// validates the token against the keys of the app before completing the
+// request. The token has to grant the scope, and the avatar of the route if
+// it has a hash.
+func AuthRequired(app *data.Application, scope string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		// Load the token from the Query String
@@ -30,7 +87,7 @@ func AuthRequired() gin.HandlerFunc {
 		}
 		if len(token) == 0 {
 			// Accept the token in the Authorization header as well
-			token = c.Request.Header.Get("Authorization")
+			token = strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
 		}
 		if len(token) == 0 {
 			c.JSON(400, gin.H{"msg": "no token was found"})
@@ -38,31 +95,122 @@ func AuthRequired() gin.HandlerFunc {
 			return
 		}
 
-		// Load the hash from the URL
-		hash := c.Param("hash")
+		auth, err := app.Keys.ParseToken(token)
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Problem with token: %s", err.Error())})
+			c.Abort()
+			return
+		}
+
+		grant, ok := authorize(c, app, auth.Claims, scope)
+		if !ok {
+			return
+		}
 
-		auth, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-			// Don't forget to validate the alg is what you expect:
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		// When tokens are single use, a token is reserved once it is accepted
+		// and spent once the request succeeds
+		if app.Tokens != nil {
+			if err := data.SpendToken(app.Tokens, auth.Claims); err == data.ErrTokenUsed {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			} else if err != nil {
+				log.Println("Error recording used token", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "could not check the token"})
+				c.Abort()
+				return
 			}
-			if t.Claims["hash"] == hash {
-				return []byte(viper.GetString("JwtKey")), nil
+		}
+
+		accept(c, auth.Claims, scope, grant)
+
+		if app.Tokens != nil && c.Writer.Status() >= 400 {
+			if err := data.RefundToken(app.Tokens, auth.Claims); err != nil {
+				log.Println("Error releasing token", err)
 			}
-			return nil, fmt.Errorf("signed hash does not match: %v", t.Claims["hash"])
-		})
+		}
+	}
+}
 
-		if err != nil {
-			c.JSON(400, gin.H{"error": fmt.Sprintf("Problem with token: %s", err.Error())})
-			c.Abort()
+// APIKeyOrTokenRequired lets services authenticate with an API key in the
+// APIKeyHeader instead of a token. The key is authorized like a token with
+// its scopes and tenant.
+func APIKeyOrTokenRequired(app *data.Application, scope string) gin.HandlerFunc {
+	tokenRequired := AuthRequired(app, scope)
+
+	return func(c *gin.Context) {
+		raw := c.Request.Header.Get(data.APIKeyHeader)
+		if len(raw) == 0 || app.APIKeys == nil {
+			tokenRequired(c)
 			return
 		}
 
-		if !auth.Valid {
-			c.JSON(400, gin.H{"error": "token was invalid for unknown reason"})
+		key, err := app.APIKeys.Verify(raw)
+		if err == data.ErrAPIKeyInvalid {
+			c.JSON(400, gin.H{"error": err.Error()})
 			c.Abort()
+			return
+		} else if err != nil {
+			log.Println("Error looking up API key", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not check the API key"})
+			c.Abort()
+			return
 		}
 
-		c.Next()
+		claims := key.Claims()
+		grant, ok := authorize(c, app, claims, scope)
+		if !ok {
+			return
+		}
+
+		accept(c, claims, scope, grant)
+	}
+}
+
+// authorize checks that the claims grant the scope and the avatar of the
+// route. Routes without a hash are about all avatars. The request is
+// aborted with 403 otherwise.
+func authorize(c *gin.Context, app *data.Application, claims map[string]interface{}, scope string) (string, bool) {
+	hash, scoped := c.Params.Get("hash")
+	var grant string
+	var err error
+	if scoped {
+		grant, err = data.AuthorizeHash(app.DB, claims, hash)
+	} else {
+		grant, err = data.AuthorizeAll(claims)
+	}
+	if err == nil {
+		err = data.CheckScope(claims, scope)
+	}
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		c.Abort()
+		return "", false
+	}
+
+	return grant, true
+}
+
+// accept logs who was let through and keeps the claims for the handlers
+func accept(c *gin.Context, claims map[string]interface{}, scope string, grant string) {
+	subject, _ := claims["sub"].(string)
+	log.Printf("[AUTH] %s %s subject=%q hash=%q scope=%s grant=%s",
+		c.Request.Method, c.Request.URL.Path, subject, c.Param("hash"), scope, grant)
+
+	c.Set(claimsKey, claims)
+
+	c.Next()
+}
+
+// claimsKey is where the claims of a valid token or API key are kept
+const claimsKey = "claims"
+
+// tokenClaim returns a string claim of the token of the request, if any
+func tokenClaim(c *gin.Context, name string) string {
+	claims, ok := c.Get(claimsKey)
+	if !ok {
+		return ""
 	}
+	value, _ := claims.(map[string]interface{})[name].(string)
+	return value
 }
@@ -1,8 +1,10 @@
 package routes
 
 import (
+	"io"
+	"log"
 	"net/http"
-	"time"
+	"strconv"
 
 	"github.com/dolfelt/avatar-go/data"
 	"github.com/gin-gonic/gin"
@@ -15,20 +17,21 @@ func read(app *data.Application) gin.HandlerFunc {
 		sizeOrBackup := c.Param("size_or_backup")
 		size := c.Param("size")
 
-		var backup string
-		if len(sizeOrBackup) == 40 {
-			backup = sizeOrBackup
-		} else if len(size) == 0 {
+		backup, isBackup := data.NormalizeHash(sizeOrBackup)
+		if !isBackup && len(size) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid backup hash"})
+			return
+		} else if !isBackup {
 			size = sizeOrBackup
 		}
 		size = data.CheckAvatarSize(size)
 
-		avatar := data.FindAvatar(app.DB, hash)
+		avatar := visible(c, data.FindAvatar(app.DB, hash))
 
 		if avatar == nil {
 			// Check for backup avatar
 			if len(backup) > 0 {
-				avatar = data.FindAvatar(app.DB, backup)
+				avatar = visible(c, data.FindAvatar(app.DB, backup))
 			}
 		}
 
@@ -42,18 +45,74 @@ func read(app *data.Application) gin.HandlerFunc {
 		}
 
 		size = avatar.BestSize(size)
-		path := avatar.GetURL(size, viper.GetString("AWSBucket"))
 
-		c.Header("Location", path)
-		c.Header("Last-Modified", avatar.UpdatedAt.Format(time.RFC822))
+		// Files without a public URL can only be served through the service,
+		// as are private ones so their location is never given out
+		url := app.Storage.URL(avatar.GetPath(size))
+		proxy := viper.GetBool("ReadProxy") || len(url) == 0 || avatar.Private
+		if proxy {
+			setCacheHeaders(c, avatar, viper.GetInt("ProxyMaxAge"))
+		} else {
+			setCacheHeaders(c, avatar, viper.GetInt("RedirectMaxAge"))
+		}
+		if avatar.Private {
+			setPrivateCacheControl(c)
+		}
+
+		if notModified(c, avatar) {
+			c.AbortWithStatus(http.StatusNotModified)
+			return
+		}
+
+		if proxy {
+			proxyAvatar(c, app.Storage, avatar, size)
+			return
+		}
+
+		c.Header("Location", url)
 		c.Status(302)
 	}
 }
 
+// proxyAvatar streams the avatar file from storage instead of redirecting
+// the client to it.
+func proxyAvatar(c *gin.Context, store data.Storage, avatar *data.Avatar, size string) {
+	body, obj, err := data.OpenAvatarFile(store, *avatar, size)
+	if err != nil {
+		log.Printf("Error fetching avatar %s %s", avatar.GetPath(size), err)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+
+	c.Header("Content-Type", avatar.ContentType())
+	if obj.Size > 0 {
+		c.Header("Content-Length", strconv.FormatInt(obj.Size, 10))
+	}
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, body)
+}
+
+// visible hides avatars that cannot be served: those without any size, and
+// private ones unless the URL is signed for them
+func visible(c *gin.Context, avatar *data.Avatar) *data.Avatar {
+	if avatar == nil || len(avatar.Sizes) == 0 {
+		return nil
+	}
+	if !avatar.Private {
+		return avatar
+	}
+
+	if data.VerifyAvatarSignature(avatar.Hash, c.Query(data.SignedURLExpires), c.Query(data.SignedURLSignature)) {
+		return avatar
+	}
+	return nil
+}
+
 func exists(app *data.Application) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		hash := c.Param("hash")
-		avatar := data.FindAvatar(app.DB, hash)
+		avatar := visible(c, data.FindAvatar(app.DB, hash))
 		if avatar == nil {
 			// http/net package does not support a response body for HEAD requests. :(
 			c.AbortWithStatus(http.StatusNotFound)
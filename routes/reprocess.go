@@ -0,0 +1,34 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+func reprocess(app *data.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		avatar := data.FindAvatarFresh(app.DB, c.Param("hash"))
+		if avatar == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no matching avatar found"})
+			return
+		}
+
+		result, err := data.ReprocessAvatar(app, *avatar, data.ReprocessOptions{Force: true})
+		if err == data.ErrConflict {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"data":   result.Avatar,
+			"source": result.Source,
+			"error":  nil,
+		})
+	}
+}
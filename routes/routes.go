@@ -22,6 +22,8 @@ func configRouter(router *gin.Engine, app *data.Application) *gin.Engine {
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 	router.Use(cors.New(getCORSConfig()))
+	router.Use(mount(adminPrefix, registerAdmin(app)))
+	router.Use(validHash())
 
 	// Get endpoints for displaying the avatar
 	router.GET("/:hash", read(app))
@@ -34,14 +36,14 @@ func configRouter(router *gin.Engine, app *data.Application) *gin.Engine {
 	// Head endpoint for determining if the avatar exists
 	router.HEAD("/:hash", exists(app))
 
-	authRouter := router.Group("/")
-	if !app.Debug {
-		authRouter.Use(AuthRequired())
-	}
+	// Endpoints changing avatars, each requiring its own scope
+	writeRouter := router.Group("/")
+	writeRouter.Use(authenticate(app, APIKeyOrTokenRequired(app, data.ScopeWrite)))
+	deleteRouter := router.Group("/")
+	deleteRouter.Use(authenticate(app, APIKeyOrTokenRequired(app, data.ScopeDelete)))
 
-	// Options endpoint for available methods
-	authRouter.POST("/:hash", write(app))
-	authRouter.DELETE("/:hash", delete(app))
+	writeRouter.POST("/:hash", write(app))
+	deleteRouter.DELETE("/:hash", delete(app))
 
 	return router
 }
@@ -0,0 +1,470 @@
+package routes
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const (
+	testHash    = "0123456789abcdef0123456789abcdef01234567"
+	testBackup  = "89abcdef0123456789abcdef0123456789abcdef"
+	testDefault = "7505d64a54e061b7acd54ccd58b49dc43500b635"
+	testBaseURL = "https://cdn.example.com/"
+)
+
+// newTestApp returns the routes of an app keeping its avatars in memory,
+// accepting tokens signed with a shared secret
+func newTestApp(t *testing.T) (*data.Application, http.Handler) {
+	gin.SetMode(gin.TestMode)
+
+	viper.Set("JwtKey", "test-secret")
+	viper.Set("HashAlgorithms", []string{"sha1"})
+	viper.Set("MasterPrefix", "masters/")
+	viper.Set("ReadProxy", false)
+	viper.Set("CacheControl", "public")
+	viper.Set("RedirectMaxAge", 300)
+	viper.Set("VersionRetention", 5)
+	viper.Set("SignedURLKey", "")
+
+	data.DefaultAvatar = &data.Avatar{Hash: testDefault, Type: "png", Sizes: data.DefaultSizeKeys()}
+
+	keys, err := data.LoadKeySet()
+	if err != nil {
+		t.Fatal("keys:", err)
+	}
+	app := &data.Application{
+		DB:         &data.MemoryDB{},
+		Storage:    &data.MemoryStorage{BaseURL: testBaseURL},
+		Keys:       keys,
+		AuthPolicy: data.AuthPolicyRequired,
+	}
+	return app, Register(app)
+}
+
+// newToken signs a token granting the scope for the hash
+func newToken(t *testing.T, hash string, scope string) string {
+	return signToken(t, map[string]interface{}{"hash": hash, "scope": scope})
+}
+
+// signToken signs a token with the claims, valid for an hour
+func signToken(t *testing.T, claims map[string]interface{}) string {
+	key, err := data.LoadSigningKey("", "")
+	if err != nil {
+		t.Fatal("signing key:", err)
+	}
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	claims["sub"] = "tester"
+
+	token, err := key.Sign(claims)
+	if err != nil {
+		t.Fatal("sign:", err)
+	}
+	return token
+}
+
+// newUpload returns a form uploading a square PNG of the given size
+func newUpload(t *testing.T, pixels int, fields map[string]string) (*bytes.Buffer, string) {
+	img := image.NewRGBA(image.Rect(0, 0, pixels, pixels))
+	for x := 0; x < pixels; x++ {
+		img.Set(x, x, color.RGBA{R: 255, A: 255})
+	}
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	file, err := form.CreateFormFile("avatar", "avatar.png")
+	if err != nil {
+		t.Fatal("form:", err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal("encode:", err)
+	}
+	form.Close()
+	return body, form.FormDataContentType()
+}
+
+func serve(router http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func upload(t *testing.T, router http.Handler, hash string, token string, fields map[string]string) *httptest.ResponseRecorder {
+	body, contentType := newUpload(t, 600, fields)
+	req := httptest.NewRequest("POST", "/"+hash, body)
+	req.Header.Set("Content-Type", contentType)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return serve(router, req)
+}
+
+func get(router http.Handler, path string) *httptest.ResponseRecorder {
+	return serve(router, httptest.NewRequest("GET", path, nil))
+}
+
+// assertRedirect checks the response redirects to a file of the avatar
+func assertRedirect(t *testing.T, w *httptest.ResponseRecorder, hash string, size string) {
+	if w.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusFound, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, testBaseURL) || !strings.Contains(location, "/"+hash+".") {
+		t.Fatalf("Location = %q, want a file of %s", location, hash)
+	}
+	if len(size) > 0 && !strings.Contains(location, "."+size+".") {
+		t.Fatalf("Location = %q, want the %s size", location, size)
+	}
+}
+
+func TestWriteAndRead(t *testing.T) {
+	app, router := newTestApp(t)
+
+	w := upload(t, router, testHash, newToken(t, testHash, data.ScopeWrite), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+
+	avatar := data.FindAvatar(app.DB, testHash)
+	if avatar == nil {
+		t.Fatal("the avatar was not saved")
+	}
+	if avatar.UploadedBy != "tester" {
+		t.Errorf("UploadedBy = %q, want the subject of the token", avatar.UploadedBy)
+	}
+	for _, size := range avatar.Sizes {
+		if _, err := app.Storage.Stat(avatar.GetPath(size)); err != nil {
+			t.Errorf("the %s size was not stored: %s", size, err)
+		}
+	}
+
+	w = get(router, "/"+testHash)
+	assertRedirect(t, w, testHash, "medium")
+	if etag := w.Header().Get("ETag"); etag != avatar.ETag() {
+		t.Errorf("ETag = %q, want %q", etag, avatar.ETag())
+	}
+
+	req := httptest.NewRequest("GET", "/"+testHash, nil)
+	req.Header.Set("If-None-Match", avatar.ETag())
+	if w := serve(router, req); w.Code != http.StatusNotModified {
+		t.Errorf("conditional status = %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	// Hashes are stored lowercase, however they are requested
+	assertRedirect(t, get(router, "/"+strings.ToUpper(testHash)), testHash, "")
+}
+
+func TestReadSizes(t *testing.T) {
+	_, router := newTestApp(t)
+	if w := upload(t, router, testHash, newToken(t, testHash, data.ScopeWrite), nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		path string
+		size string
+	}{
+		{"/" + testHash + "/small", "small"},
+		{"/" + testHash + "/large", "large"},
+		{"/" + testHash + "/100", "small"},
+		{"/" + testHash + "/unknown", "medium"},
+	}
+	for _, tt := range tests {
+		assertRedirect(t, get(router, tt.path), testHash, tt.size)
+	}
+
+	// A 600 pixel upload is too small for the original size, so another
+	// one is served in its place
+	w := get(router, "/"+testHash+"/original")
+	assertRedirect(t, w, testHash, "")
+	if strings.Contains(w.Header().Get("Location"), ".original.") {
+		t.Errorf("Location = %q, a size the avatar does not have", w.Header().Get("Location"))
+	}
+}
+
+func TestReadFallbacks(t *testing.T) {
+	_, router := newTestApp(t)
+	if w := upload(t, router, testBackup, newToken(t, testBackup, data.ScopeWrite), nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+
+	// The backup is served when the avatar does not exist
+	assertRedirect(t, get(router, "/"+testHash+"/"+testBackup), testBackup, "")
+	assertRedirect(t, get(router, "/"+testHash+"/"+testBackup+"/small"), testBackup, "small")
+
+	// The default avatar when neither does
+	missing := strings.Repeat("f", 40)
+	assertRedirect(t, get(router, "/"+testHash+"/"+missing), testDefault, "")
+	assertRedirect(t, get(router, "/"+testHash), testDefault, "")
+
+	if w := get(router, "/"+testHash+"/nothex/small"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid backup status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := get(router, "/nothex"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid hash status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	data.DefaultAvatar = &data.Avatar{}
+	if w := get(router, "/"+testHash); w.Code != http.StatusNotFound {
+		t.Errorf("status without a default = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestReadPrivate(t *testing.T) {
+	app, router := newTestApp(t)
+	w := upload(t, router, testHash, newToken(t, testHash, data.ScopeWrite), map[string]string{"private": "true"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	if avatar := data.FindAvatar(app.DB, testHash); avatar == nil || !avatar.Private {
+		t.Fatal("the avatar was not saved as private")
+	}
+
+	// Without a signed URL, a private avatar is as good as missing
+	assertRedirect(t, get(router, "/"+testHash), testDefault, "")
+	if w := serve(router, httptest.NewRequest("HEAD", "/"+testHash, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("head status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestWriteMakesVersionsPrivate(t *testing.T) {
+	app, router := newTestApp(t)
+	viper.Set("SignedURLKey", "test-url-secret")
+	store := app.Storage.(*data.MemoryStorage)
+	token := newToken(t, testHash, data.ScopeWrite)
+
+	if w := upload(t, router, testHash, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	public := data.FindAvatar(app.DB, testHash)
+	publicURL := get(router, "/"+testHash).Header().Get("Location")
+
+	w := upload(t, router, testHash, token, map[string]string{"private": "true"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("private upload status = %d: %s", w.Code, w.Body)
+	}
+
+	// The URLs handed out for the public version must stop working
+	for _, size := range public.Sizes {
+		key := public.GetPath(size)
+		if opts, ok := store.Options(key); !ok || !opts.Private {
+			t.Errorf("the %s size of the previous version is still public", size)
+		}
+		if url := store.URL(key); len(url) > 0 {
+			t.Errorf("the %s size of the previous version has the URL %s", size, url)
+		}
+	}
+
+	// Reads never redirect to any of the files, not even when signed
+	path, err := data.SignAvatarURL(testHash, "", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal("sign:", err)
+	}
+	w = get(router, path)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed status = %d, want the file through the service", w.Code)
+	}
+	if location := w.Header().Get("Location"); len(location) > 0 {
+		t.Errorf("a private avatar redirected to %s", location)
+	}
+	if location := get(router, "/"+testHash).Header().Get("Location"); location == publicURL {
+		t.Errorf("an unsigned read still redirects to the previous version")
+	}
+}
+
+func TestHead(t *testing.T) {
+	_, router := newTestApp(t)
+
+	if w := serve(router, httptest.NewRequest("HEAD", "/"+testHash, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("status before upload = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := upload(t, router, testHash, newToken(t, testHash, data.ScopeWrite), nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(router, httptest.NewRequest("HEAD", "/"+testHash, nil)); w.Code != http.StatusNoContent {
+		t.Errorf("status after upload = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestWriteAuth(t *testing.T) {
+	app, router := newTestApp(t)
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"no token", "", http.StatusBadRequest},
+		{"invalid token", "not-a-token", http.StatusBadRequest},
+		{"other hash", newToken(t, testBackup, data.ScopeWrite), http.StatusForbidden},
+		{"other scope", newToken(t, testHash, data.ScopeDelete), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := upload(t, router, testHash, tt.token, nil); w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+	if data.FindAvatar(app.DB, testHash) != nil {
+		t.Fatal("an unauthorized upload was saved")
+	}
+
+	// Requests from the host itself need no token when the policy says so
+	app.AuthPolicy = data.AuthPolicyDisabledForLoopback
+	router = Register(app)
+
+	body, contentType := newUpload(t, 200, nil)
+	req := httptest.NewRequest("POST", "/"+testHash, body)
+	req.Header.Set("Content-Type", contentType)
+	req.RemoteAddr = "203.0.113.7:4000"
+	if w := serve(router, req); w.Code != http.StatusBadRequest {
+		t.Errorf("remote status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	body, contentType = newUpload(t, 200, nil)
+	req = httptest.NewRequest("POST", "/"+testHash, body)
+	req.Header.Set("Content-Type", contentType)
+	req.RemoteAddr = "127.0.0.1:4000"
+	if w := serve(router, req); w.Code != http.StatusOK {
+		t.Errorf("loopback status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestWriteTenant(t *testing.T) {
+	app, router := newTestApp(t)
+	tenant := signToken(t, map[string]interface{}{"tenant": "acme", "scope": data.ScopeWrite})
+
+	// A new avatar belongs to no tenant yet
+	if w := upload(t, router, testHash, tenant, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("new avatar status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	first := signToken(t, map[string]interface{}{"hash": testHash, "tenant": "acme", "scope": data.ScopeWrite})
+	if w := upload(t, router, testHash, first, nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	if avatar := data.FindAvatar(app.DB, testHash); avatar == nil || avatar.Tenant != "acme" {
+		t.Fatal("the avatar was not saved for the tenant")
+	}
+
+	if w := upload(t, router, testHash, tenant, nil); w.Code != http.StatusOK {
+		t.Errorf("tenant status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	other := signToken(t, map[string]interface{}{"tenant": "other", "scope": data.ScopeWrite})
+	if w := upload(t, router, testHash, other, nil); w.Code != http.StatusForbidden {
+		t.Errorf("other tenant status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestWriteSingleUse(t *testing.T) {
+	app, router := newTestApp(t)
+	app.Tokens = &data.MemoryTokenStore{}
+	router = Register(app)
+	token := signToken(t, map[string]interface{}{"hash": testHash, "scope": data.ScopeWrite, "jti": "upload-1"})
+
+	// A failed upload does not use the token up
+	req := httptest.NewRequest("POST", "/"+testHash, strings.NewReader("not an image"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if w := serve(router, req); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid upload status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := upload(t, router, testHash, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	if w := upload(t, router, testHash, token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("replayed token status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestWriteReplaces(t *testing.T) {
+	app, router := newTestApp(t)
+	token := newToken(t, testHash, data.ScopeWrite)
+
+	if w := upload(t, router, testHash, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	first := data.FindAvatar(app.DB, testHash)
+
+	if w := upload(t, router, testHash, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("second upload status = %d: %s", w.Code, w.Body)
+	}
+	second := data.FindAvatar(app.DB, testHash)
+
+	if second.Version != first.Version+1 {
+		t.Errorf("Version = %d, want %d", second.Version, first.Version+1)
+	}
+	if !second.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("CreatedAt = %s, want it kept at %s", second.CreatedAt, first.CreatedAt)
+	}
+	assertRedirect(t, get(router, "/"+testHash), testHash+".v2-"+second.UploadID, "")
+
+	if w := upload(t, router, testHash, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	versions, err := app.DB.FindVersions(testHash)
+	if err != nil {
+		t.Fatal("versions:", err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("%d previous versions were kept, want 2", len(versions))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	app, router := newTestApp(t)
+	if w := upload(t, router, testHash, newToken(t, testHash, data.ScopeWrite), nil); w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	avatar := data.FindAvatar(app.DB, testHash)
+
+	remove := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/"+testHash, nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return serve(router, req)
+	}
+
+	if w := remove(""); w.Code != http.StatusBadRequest {
+		t.Errorf("status without token = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := remove(newToken(t, testHash, data.ScopeWrite)); w.Code != http.StatusForbidden {
+		t.Errorf("status with the write scope = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if data.FindAvatar(app.DB, testHash) == nil {
+		t.Fatal("an unauthorized delete removed the avatar")
+	}
+
+	token := newToken(t, testHash, data.ScopeDelete)
+	if w := remove(token); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+	if data.FindAvatar(app.DB, testHash) != nil {
+		t.Error("the avatar was not deleted")
+	}
+	for _, size := range avatar.Sizes {
+		if _, err := app.Storage.Stat(avatar.GetPath(size)); err == nil {
+			t.Errorf("the %s size was not deleted", size)
+		}
+	}
+	assertRedirect(t, get(router, "/"+testHash), testDefault, "")
+
+	if w := remove(token); w.Code != http.StatusNotFound {
+		t.Errorf("status of a second delete = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
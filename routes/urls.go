@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSignedURLTTL is how long signed URLs are valid unless asked otherwise
+const defaultSignedURLTTL = time.Hour
+
+// signURL hands out a URL that reads the avatar until it expires, even when
+// it is private
+func signURL(app *data.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hash := c.Param("hash")
+
+		ttl := defaultSignedURLTTL
+		if value := c.Query("ttl"); len(value) > 0 {
+			var err error
+			ttl, err = time.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive duration, i.e. 10m"})
+				return
+			}
+		}
+
+		if data.FindAvatar(app.DB, hash) == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no matching avatar found"})
+			return
+		}
+
+		expires := time.Now().Add(ttl)
+		url, err := data.SignAvatarURL(hash, c.Query("size"), expires)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"data": gin.H{
+				"url":     url,
+				"expires": expires.UTC().Format(time.RFC3339),
+			},
+			"error": nil,
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dolfelt/avatar-go/data"
+	"github.com/gin-gonic/gin"
+)
+
+func listVersions(app *data.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hash := c.Param("hash")
+
+		versions, err := app.DB.FindVersions(hash)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		current := data.FindAvatar(app.DB, hash)
+		if current == nil && len(versions) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no matching avatar found"})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"data": gin.H{
+				"current":  current,
+				"versions": versions,
+			},
+			"error": nil,
+		})
+	}
+}
+
+func restoreVersion(app *data.Application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version, err := strconv.Atoi(c.Param("version"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a number"})
+			return
+		}
+
+		avatar, err := data.RestoreVersion(app, c.Param("hash"), version)
+		if err != nil {
+			if _, ok := err.(*data.AppError); ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			if err == data.ErrConflict {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"data":  avatar,
+			"error": nil,
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/dolfelt/avatar-go/data"
@@ -20,37 +22,85 @@ func write(app *data.Application) gin.HandlerFunc {
 
 		hash := c.Param("hash")
 
-		oldAvatar := data.FindAvatar(app.DB, hash)
-		if oldAvatar != nil {
-			data.ClearAvatarFiles(*oldAvatar)
+		// Visibility is kept unless the upload changes it
+		var private *bool
+		if value, ok := c.GetPostForm("private"); ok {
+			p, err := strconv.ParseBool(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "private must be true or false"})
+				return
+			}
+			private = &p
 		}
 
+		oldAvatar := data.FindAvatarFresh(app.DB, hash)
+
+		now := time.Now()
 		newAvatar := data.Avatar{
-			Hash: hash,
-			Type: ext,
+			Hash:       hash,
+			Type:       ext,
+			Version:    1,
+			UploadID:   data.NewUploadID(),
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			UploadedBy: tokenClaim(c, "sub"),
+			Tenant:     tokenClaim(c, "tenant"),
+		}
+		if oldAvatar != nil {
+			newAvatar.Version = oldAvatar.Version + 1
+			newAvatar.Revision = oldAvatar.Revision
+			newAvatar.CreatedAt = oldAvatar.CreatedAt
+
+			// An avatar stays with the tenant it was first uploaded for
+			if len(oldAvatar.Tenant) > 0 {
+				newAvatar.Tenant = oldAvatar.Tenant
+			}
+			newAvatar.Private = oldAvatar.Private
+		}
+		if private != nil {
+			newAvatar.Private = *private
 		}
-		data, err := data.ProcessImageUpload(app, newAvatar, file)
+		err = data.ProcessImageUpload(app, &newAvatar, file)
 
-		if err != nil {
+		if _, ok := err.(*data.ImageError); ok {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
-		}
-
-		for size := range data {
-			newAvatar.Sizes = append(newAvatar.Sizes, size)
+		} else if err != nil {
+			// Failures of the storage are not the fault of the client
+			log.Printf("Error storing the upload of avatar %s %s", hash, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "the avatar could not be stored"})
+			return
 		}
 
 		err = newAvatar.Save(app.DB)
-
-		now := time.Now()
-		newAvatar.UpdatedAt = now
-		newAvatar.CreatedAt = now
-
 		if err != nil {
+			// The new version was never published, so drop its files. Those
+			// of a concurrent upload have another upload ID.
+			data.ClearAvatarFiles(app.Storage, newAvatar)
+			if err == data.ErrConflict {
+				c.JSON(http.StatusConflict, gin.H{"error": "the avatar was replaced by another upload, please try again"})
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
+		// Only archive the previous version once the new one is live, so
+		// readers are never redirected to files that no longer exist
+		if oldAvatar != nil {
+			if err := data.ArchiveVersion(app, *oldAvatar); err != nil {
+				log.Printf("Error archiving version %d of avatar %s %s", oldAvatar.Version, hash, err)
+			}
+		}
+
+		// The files of earlier versions were public, and their URLs may have
+		// been handed out already
+		if oldAvatar != nil && newAvatar.Private && !oldAvatar.Private {
+			if err := data.MakeVersionsPrivate(app, hash); err != nil {
+				log.Printf("Error making the previous versions of avatar %s private, they can still be downloaded %s", hash, err)
+			}
+		}
+
 		c.JSON(200, gin.H{
 			"data":  newAvatar,
 			"error": nil,
@@ -61,9 +111,9 @@ func write(app *data.Application) gin.HandlerFunc {
 func delete(app *data.Application) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		oldAvatar := data.FindAvatar(app.DB, c.Param("hash"))
+		oldAvatar := data.FindAvatarFresh(app.DB, c.Param("hash"))
 		if oldAvatar != nil {
-			err := data.ClearAvatarFiles(*oldAvatar)
+			err := data.DeleteAvatar(app, *oldAvatar)
 			if err != nil {
 				c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
 				return